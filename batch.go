@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smilyorg/findimg/match"
+)
+
+// batchResult is the outcome of searching one haystack in batch mode.
+type batchResult struct {
+	Image   string        `json:"image"`
+	Matches match.Matches `json:"matches"`
+	Error   string        `json:"error,omitempty"`
+	status  int
+	elapsed time.Duration
+	// Whether the image has multiple frames
+	animated bool
+}
+
+// runBatch searches for the subimage in every image in imgPaths, which can
+// also be directories or globs. Up to -j images are decoded and searched
+// concurrently, the results are printed to w in order as soon as they are
+// ready.
+//
+// The returned exit status is exitFound if the subimage was found in any of
+// the images, unless searching any of them failed.
+func runBatch(w io.Writer, subimgPath string, imgPaths []string) int {
+	if *random {
+		return errorf(exitUsage, "-random is not supported in batch mode")
+	}
+	if *output == "html" || imageOutput() {
+		return errorf(exitUsage, "%s output is not supported in batch mode", *output)
+	}
+
+	subsrc, err := openImage(subimgPath)
+	if err != nil {
+		return errorf(exitIO, "failed to open image: %v", err)
+	}
+
+	if *mask != "" {
+		maskimg, err := openImage(*mask)
+		if err != nil {
+			return errorf(exitIO, "failed to open mask: %v", err)
+		}
+		subsrc = match.ApplyMask(subsrc, maskimg)
+	}
+
+	var paths []string
+	for _, path := range imgPaths {
+		expanded, err := expandBatchPath(path)
+		if err != nil {
+			return errorf(exitIO, "failed to read images: %v", err)
+		}
+		paths = append(paths, expanded...)
+	}
+
+	opts, err := matchOptions()
+	if err != nil {
+		return errorf(exitUsage, "%v", err)
+	}
+	ctx, cancel := searchContext()
+	defer cancel()
+
+	results := make([]batchResult, len(paths))
+	done := make([]chan struct{}, len(paths))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	queue := make(chan int)
+	workers := *jobs
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = searchBatch(ctx, paths[i], extractPrefix(i, len(paths), paths[i]), subsrc, opts)
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range paths {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	found := false
+	failed := exitFound
+	enc := json.NewEncoder(w)
+	records := newRecordWriter(w, *output, *raw)
+	for i := range paths {
+		<-done[i]
+		r := results[i]
+		if r.status == exitFound {
+			found = true
+		} else if r.status > failed && r.status != exitNotFound {
+			failed = r.status
+		}
+		switch *output {
+		case "json":
+			enc.Encode(r)
+		case "csv", "ndjson":
+			if r.Error != "" {
+				log.Printf("failed to find image in %s: %s", r.Image, r.Error)
+			}
+			if err := records.write(newRecords(r.Image, subimgPath, r.Matches, r.elapsed)); err != nil {
+				log.Printf("failed to write results: %v", err)
+				if exitIO > failed {
+					failed = exitIO
+				}
+			}
+		default:
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "==> %s <==\n", r.Image)
+			if r.Error != "" {
+				log.Printf("failed to find image in %s: %s", r.Image, r.Error)
+			}
+			printText(w, r.Matches, r.animated)
+		}
+	}
+	wg.Wait()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("search timed out after %v, matches are partial", *timeout)
+		return exitError
+	}
+	if failed != exitFound {
+		return failed
+	}
+	if !found {
+		return exitNotFound
+	}
+	return exitFound
+}
+
+// searchBatch searches for subsrc in the image in path, naming the matches
+// extracted with -extract by prefix.
+func searchBatch(ctx context.Context, path string, prefix string, subsrc image.Image, opts match.Options) batchResult {
+	r := batchResult{Image: path}
+
+	frames, orientation, err := openFrames(path)
+	if err != nil {
+		r.Error = err.Error()
+		r.status = exitIO
+		return r
+	}
+
+	start := time.Now()
+	r.animated = len(frames) > 1
+	if r.animated {
+		r.Matches, err = match.FindFrames(ctx, frames, subsrc, opts)
+	} else {
+		r.Matches, err = match.Find(ctx, frames[0], subsrc, opts)
+	}
+	r.elapsed = time.Since(start)
+	if err != nil && !errors.Is(err, match.ErrNoMatches) {
+		r.Error = err.Error()
+	}
+	if *raw {
+		r.Matches.Orient(orientation, frames[0].Bounds().Size())
+	}
+	if *extract != "" {
+		if err := extractMatches(prefix, frames, subsrc, r.Matches); err != nil {
+			r.Error = fmt.Sprintf("failed to extract matches: %v", err)
+			r.status = exitIO
+			return r
+		}
+	}
+	r.status = exitCode(err)
+	return r
+}
+
+// expandBatchPath returns the images matching path if it is a glob, the ones
+// in it if it is a directory, or path itself otherwise.
+func expandBatchPath(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		paths, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no images match %s", path)
+		}
+		return paths, nil
+	}
+	paths, _, err := expandDir(path)
+	return paths, err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setBatchFlags sets the flags used by runBatch for the duration of the test.
+func setBatchFlags(t *testing.T, format string) {
+	o, j, n := *output, *jobs, *k
+	t.Cleanup(func() {
+		*output, *jobs, *k = o, j, n
+	})
+	*output = format
+	*jobs = 3
+	*k = 2
+}
+
+// batchPaths returns the images searched by the tests. The first one takes
+// the longest to search, so the later ones are done first but still have to
+// be printed after it. The third one is not an image.
+func batchPaths(t *testing.T) []string {
+	broken := filepath.Join(t.TempDir(), "broken.jpg")
+	if err := os.WriteFile(broken, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return []string{
+		"assets/html.jpg",
+		"assets/haystack.jpg",
+		broken,
+		"assets/haystack.jpg",
+	}
+}
+
+func TestRunBatchText(t *testing.T) {
+	setBatchFlags(t, "")
+
+	paths := batchPaths(t)
+	var buf bytes.Buffer
+	if code := runBatch(&buf, "assets/needle.jpg", paths); code != exitIO {
+		t.Errorf("expected exit status %d, got %d", exitIO, code)
+	}
+
+	var headers []string
+	lines := 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "==> ") {
+			headers = append(headers, strings.TrimSuffix(strings.TrimPrefix(line, "==> "), " <=="))
+		} else if line != "" {
+			lines++
+		}
+	}
+	if strings.Join(headers, ",") != strings.Join(paths, ",") {
+		t.Errorf("expected images in order %v, got %v", paths, headers)
+	}
+	if lines != 3**k {
+		t.Errorf("expected %d matches, got %d:\n%s", 3**k, lines, buf.String())
+	}
+}
+
+func TestRunBatchCSV(t *testing.T) {
+	setBatchFlags(t, "csv")
+
+	paths := batchPaths(t)
+	var buf bytes.Buffer
+	runBatch(&buf, "assets/needle.jpg", paths)
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || rows[0][0] != "image" {
+		t.Fatalf("expected header row, got %v", rows)
+	}
+	var images []string
+	for _, row := range rows[1:] {
+		if row[0] == "image" {
+			t.Errorf("expected a single header row, got another one")
+		}
+		images = append(images, row[0])
+	}
+	want := []string{
+		paths[0], paths[0],
+		paths[1], paths[1],
+		paths[3], paths[3],
+	}
+	if strings.Join(images, ",") != strings.Join(want, ",") {
+		t.Errorf("expected rows of %v, got %v", want, images)
+	}
+}
+
+func TestRunBatchNDJSON(t *testing.T) {
+	setBatchFlags(t, "ndjson")
+
+	paths := batchPaths(t)
+	var buf bytes.Buffer
+	runBatch(&buf, "assets/needle.jpg", paths)
+
+	var images []string
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if r.Subimage != "assets/needle.jpg" || r.Rank != len(images)%*k+1 {
+			t.Errorf("line %d: unexpected record %+v", i, r)
+		}
+		images = append(images, r.Image)
+	}
+	want := []string{
+		paths[0], paths[0],
+		paths[1], paths[1],
+		paths[3], paths[3],
+	}
+	if strings.Join(images, ",") != strings.Join(want, ",") {
+		t.Errorf("expected records of %v, got %v", want, images)
+	}
+}
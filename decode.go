@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+
+	"github.com/smilyorg/findimg/match"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// stdinPath is the path of images read from the standard input.
+const stdinPath = "-"
+
+// open opens filename, or the standard input if it is stdinPath.
+func open(filename string) (io.ReadCloser, error) {
+	if filename == stdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filename)
+}
+
+// openImage decodes the image in filename as it is displayed, or the first
+// frame if it is animated.
+func openImage(filename string) (image.Image, error) {
+	file, err := open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := decodeImage(bufio.NewReader(file))
+	return img, err
+}
+
+// openFrames decodes all the frames of an animated GIF in filename, or the
+// image as the only frame if it is any other format. The frames are oriented
+// as they are displayed and the returned orientation maps them back to the
+// raw pixels, see match.Matches.Orient.
+func openFrames(filename string) ([]image.Image, match.Orientation, error) {
+	file, err := open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(4)
+	if bytes.Equal(magic, []byte("GIF8")) {
+		frames, err := decodeGIF(r)
+		return frames, 1, err
+	}
+
+	img, orientation, err := decodeImage(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return []image.Image{img}, orientation, nil
+}
+
+// decodeImage decodes an image of any registered format and applies the EXIF
+// orientation of JPEGs, which it also returns. The orientation of other
+// formats is 1.
+func decodeImage(r *bufio.Reader) (image.Image, match.Orientation, error) {
+	magic, _ := r.Peek(2)
+	if !bytes.Equal(magic, []byte{0xff, 0xd8}) {
+		img, _, err := image.Decode(r)
+		return img, 1, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	orientation := jpegOrientation(data)
+	return orientation.Apply(img), orientation, nil
+}
+
+// jpegOrientation returns the orientation tag of the EXIF metadata in a JPEG,
+// or 1 if there is none.
+func jpegOrientation(data []byte) match.Orientation {
+	if len(data) < 2 {
+		return 1
+	}
+	data = data[2:]
+	for len(data) >= 4 && data[0] == 0xff {
+		marker := data[1]
+		size := int(binary.BigEndian.Uint16(data[2:4]))
+		if marker == 0xda || size < 2 || len(data) < 2+size {
+			// Start of scan, no more metadata
+			return 1
+		}
+		segment := data[4 : 2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		data = data[2+size:]
+	}
+	return 1
+}
+
+// exifOrientation returns the orientation tag (0x0112) of the first IFD in
+// the TIFF structure of EXIF metadata, or 1 if there is none or it is
+// malformed or out of range.
+func exifOrientation(tiff []byte) match.Orientation {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	count := int64(order.Uint16(tiff[ifd:]))
+	for i := int64(0); i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		tag := order.Uint16(tiff[entry:])
+		typ := order.Uint16(tiff[entry+2:])
+		if tag == 0x0112 && typ == 3 {
+			o := order.Uint16(tiff[entry+8:])
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return match.Orientation(o)
+		}
+	}
+	return 1
+}
+
+// decodeGIF returns the frames of a GIF as they are displayed, with each
+// frame drawn over the previous ones according to their disposal method.
+func decodeGIF(r io.Reader) ([]image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, 0, len(g.Image))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneRGBA(canvas))
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames, nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	clone := image.NewRGBA(img.Bounds())
+	copy(clone.Pix, img.Pix)
+	return clone
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smilyorg/findimg/match"
+)
+
+// exifTIFF returns the TIFF structure of EXIF metadata with one IFD at offset
+// 8 holding the given tag, type and value.
+func exifTIFF(order binary.ByteOrder, tag uint16, typ uint16, value uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], tag)
+	order.PutUint16(tiff[12:], typ)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], value)
+	return tiff
+}
+
+func TestExifOrientation(t *testing.T) {
+	le := exifTIFF(binary.LittleEndian, 0x0112, 3, 6)
+	be := exifTIFF(binary.BigEndian, 0x0112, 3, 8)
+
+	badOffset := exifTIFF(binary.LittleEndian, 0x0112, 3, 6)
+	binary.LittleEndian.PutUint32(badOffset[4:], 0xfffffff0)
+
+	lowOffset := exifTIFF(binary.BigEndian, 0x0112, 3, 6)
+	binary.BigEndian.PutUint32(lowOffset[4:], 2)
+
+	badCount := exifTIFF(binary.LittleEndian, 0x0100, 3, 6)
+	binary.LittleEndian.PutUint16(badCount[8:], 0xffff)
+
+	tests := []struct {
+		name string
+		tiff []byte
+		want match.Orientation
+	}{
+		{"little endian", le, 6},
+		{"big endian", be, 8},
+		{"missing tag", exifTIFF(binary.LittleEndian, 0x0100, 3, 6), 1},
+		{"wrong type", exifTIFF(binary.LittleEndian, 0x0112, 4, 6), 1},
+		{"zero", exifTIFF(binary.BigEndian, 0x0112, 3, 0), 1},
+		{"out of range", exifTIFF(binary.BigEndian, 0x0112, 3, 9), 1},
+		{"large", exifTIFF(binary.LittleEndian, 0x0112, 3, 0xffff), 1},
+		{"empty", nil, 1},
+		{"short header", le[:6], 1},
+		{"bad byte order", append([]byte("XX"), le[2:]...), 1},
+		{"truncated ifd", le[:9], 1},
+		{"truncated entry", le[:16], 1},
+		{"offset past end", badOffset, 1},
+		{"offset in header", lowOffset, 1},
+		{"count past end", badCount, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.tiff); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// app1 returns a JPEG APP1 segment holding payload.
+func app1(payload []byte) []byte {
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(payload)))
+	return append(segment, payload...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), exifTIFF(binary.BigEndian, 0x0112, 3, 3)...)
+	soi := []byte{0xff, 0xd8}
+	sos := []byte{0xff, 0xda, 0, 2}
+
+	tests := []struct {
+		name string
+		data []byte
+		want match.Orientation
+	}{
+		{"exif", concat(soi, app1(exif), sos), 3},
+		{"after other segment", concat(soi, app1([]byte("http://ns.adobe.com/xap/1.0/\x00")), app1(exif), sos), 3},
+		{"no exif", concat(soi, sos), 1},
+		{"after scan", concat(soi, sos, app1(exif)), 1},
+		{"truncated segment", concat(soi, app1(exif)[:10]), 1},
+		{"bad segment size", concat(soi, []byte{0xff, 0xe1, 0, 1}, exif), 1},
+		{"soi only", soi, 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeGIF(t *testing.T) {
+	transparent := color.RGBA{}
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	palette := color.Palette{transparent, red, green, blue, white}
+
+	fill := func(r image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(r, palette)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			fill(image.Rect(0, 0, 4, 4), red),
+			fill(image.Rect(0, 0, 2, 2), green),
+			fill(image.Rect(2, 2, 4, 4), blue),
+			fill(image.Rect(3, 0, 4, 1), white),
+		},
+		Delay: []int{0, 0, 0, 0},
+		Disposal: []byte{
+			gif.DisposalNone,
+			gif.DisposalBackground,
+			gif.DisposalPrevious,
+			gif.DisposalNone,
+		},
+		Config: image.Config{ColorModel: palette, Width: 4, Height: 4},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := decodeGIF(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(anim.Image) {
+		t.Fatalf("expected %d frames, got %d", len(anim.Image), len(frames))
+	}
+
+	// Expected colors of each frame, by row
+	r, g, b, w, o := red, green, blue, white, transparent
+	want := [][4][4]color.RGBA{
+		// Drawn over the empty canvas and kept
+		{{r, r, r, r}, {r, r, r, r}, {r, r, r, r}, {r, r, r, r}},
+		// Drawn over the first frame, then cleared to the background
+		{{g, g, r, r}, {g, g, r, r}, {r, r, r, r}, {r, r, r, r}},
+		// Drawn over the cleared canvas, then restored to it
+		{{o, o, r, r}, {o, o, r, r}, {r, r, b, b}, {r, r, b, b}},
+		{{o, o, r, w}, {o, o, r, r}, {r, r, r, r}, {r, r, r, r}},
+	}
+	for i, frame := range frames {
+		if frame.Bounds() != image.Rect(0, 0, 4, 4) {
+			t.Errorf("frame %d: expected bounds %v, got %v", i, image.Rect(0, 0, 4, 4), frame.Bounds())
+			continue
+		}
+		for y, row := range want[i] {
+			for x, c := range row {
+				if got := color.RGBAModel.Convert(frame.At(x, y)); got != c {
+					t.Errorf("frame %d: expected %v at %d,%d, got %v", i, c, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+// encodedImages returns a 4x2 image encoded as PNG, as JPEG with the EXIF
+// orientation 6 (rotated 90° clockwise), as GIF and as an animated GIF of two
+// frames.
+func encodedImages(t *testing.T) map[string][]byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	var pngs, jpg, gifs, anim bytes.Buffer
+	if err := png.Encode(&pngs, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpg, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifs, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	frame := image.NewPaletted(img.Bounds(), color.Palette{color.White, color.Black})
+	err := gif.EncodeAll(&anim, &gif.GIF{
+		Image: []*image.Paletted{frame, frame},
+		Delay: []int{0, 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exif := append([]byte("Exif\x00\x00"), exifTIFF(binary.BigEndian, 0x0112, 3, 6)...)
+	data := jpg.Bytes()
+	return map[string][]byte{
+		"png":  pngs.Bytes(),
+		"jpeg": concat(data[:2], app1(exif), data[2:]),
+		"gif":  gifs.Bytes(),
+		"anim": anim.Bytes(),
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	images := encodedImages(t)
+	tests := []struct {
+		format      string
+		size        image.Point
+		orientation match.Orientation
+	}{
+		{"png", image.Pt(4, 2), 1},
+		{"jpeg", image.Pt(2, 4), 6},
+		{"gif", image.Pt(4, 2), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			img, orientation, err := decodeImage(bufio.NewReader(bytes.NewReader(images[tt.format])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Size() != tt.size {
+				t.Errorf("expected size %v, got %v", tt.size, img.Bounds().Size())
+			}
+			if orientation != tt.orientation {
+				t.Errorf("expected orientation %d, got %d", tt.orientation, orientation)
+			}
+		})
+	}
+
+	if _, _, err := decodeImage(bufio.NewReader(strings.NewReader("not an image"))); err == nil {
+		t.Error("expected an error decoding garbage")
+	}
+}
+
+// setStdin replaces the standard input with data for the duration of the
+// test.
+func setStdin(t *testing.T, data []byte) {
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		f.Close()
+	})
+}
+
+func TestOpenFramesStdin(t *testing.T) {
+	images := encodedImages(t)
+	tests := []struct {
+		format      string
+		frames      int
+		size        image.Point
+		orientation match.Orientation
+	}{
+		{"png", 1, image.Pt(4, 2), 1},
+		{"jpeg", 1, image.Pt(2, 4), 6},
+		{"gif", 1, image.Pt(4, 2), 1},
+		{"anim", 2, image.Pt(4, 2), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			setStdin(t, images[tt.format])
+			frames, orientation, err := openFrames(stdinPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != tt.frames {
+				t.Fatalf("expected %d frames, got %d", tt.frames, len(frames))
+			}
+			for i, frame := range frames {
+				if frame.Bounds().Size() != tt.size {
+					t.Errorf("frame %d: expected size %v, got %v", i, tt.size, frame.Bounds().Size())
+				}
+			}
+			if orientation != tt.orientation {
+				t.Errorf("expected orientation %d, got %d", tt.orientation, orientation)
+			}
+		})
+	}
+
+	// openImage only decodes the first frame
+	setStdin(t, images["anim"])
+	if img, err := openImage(stdinPath); err != nil || img.Bounds().Size() != image.Pt(4, 2) {
+		t.Errorf("expected the first frame, got %v, %v", img, err)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+	return data
+}
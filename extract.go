@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/smilyorg/findimg/match"
+	"golang.org/x/image/draw"
+)
+
+// extractMatches writes the region of each match, grown by -extract-pad
+// pixels on every side, as a PNG file named by prefix, rank and score into
+// the -extract directory.
+func extractMatches(prefix string, frames []image.Image, subsrc image.Image, matches match.Matches) error {
+	if err := os.MkdirAll(*extract, 0o755); err != nil {
+		return err
+	}
+
+	digits := len(strconv.Itoa(len(matches)))
+	for i, m := range matches {
+		img := sourceImage(frames, subsrc, m)
+		r := m.Bounds.Inset(-*extractPad).Intersect(img.Bounds())
+		crop := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(crop, crop.Bounds(), img, r.Min, draw.Src)
+
+		name := fmt.Sprintf("%0*d-%.3f.png", digits, i+1, m.Match)
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		if err := writePNG(filepath.Join(*extract, name), crop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractPrefix returns the 1-based index i of path among n images and its
+// name without directory and extension, to tell apart the extracted matches
+// of several images. The index keeps them apart if the names are the same,
+// e.g. a/icon.png and b/icon.png, or icon.png and icon.jpg.
+func extractPrefix(i int, n int, path string) string {
+	name := "stdin"
+	if path != stdinPath {
+		base := filepath.Base(path)
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return fmt.Sprintf("%0*d-%s", len(strconv.Itoa(n)), i+1, name)
+}
+
+// sourceImage returns the image a match was found in, which is the subimage
+// if it is swapped or its frame otherwise.
+func sourceImage(frames []image.Image, subsrc image.Image, m match.Match) image.Image {
+	if m.Swapped {
+		return subsrc
+	}
+	return frames[m.Frame]
+}
+
+func writePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
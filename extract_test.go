@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestExtractPrefix(t *testing.T) {
+	paths := []string{"a/icon.png", "b/icon.png", "icon.jpg", stdinPath}
+	want := []string{"1-icon", "2-icon", "3-icon", "4-stdin"}
+
+	seen := make(map[string]bool)
+	for i, path := range paths {
+		prefix := extractPrefix(i, len(paths), path)
+		if prefix != want[i] {
+			t.Errorf("%s: expected %s, got %s", path, want[i], prefix)
+		}
+		if seen[prefix] {
+			t.Errorf("%s: duplicate prefix %s", path, prefix)
+		}
+		seen[prefix] = true
+	}
+
+	if prefix := extractPrefix(2, 10, "x.png"); prefix != "03-x" {
+		t.Errorf("expected 03-x, got %s", prefix)
+	}
+}
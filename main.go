@@ -1,83 +1,54 @@
 package main
 
 import (
-	"bytes"
-	"embed"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"image"
-	"image/color"
-	_ "image/jpeg"
+	"image/jpeg"
 	"image/png"
+	"io"
 	"log"
-	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
-	"sort"
-	"sync"
+	"strings"
+	"time"
 
+	"github.com/smilyorg/findimg/match"
 	"golang.org/x/image/draw"
 )
 
-type Run struct {
-	Size    image.Point
-	Subruns []Subrun
-}
-
-type Subrun struct {
-	Image       image.Image
-	Selected    bool
-	Skipped     bool
-	Reason      string
-	Subimage    image.Image
-	Convolution image.Image
-	Visualized  image.Image
-	Matches     []Match
-}
-
-type Matches []Match
-
-func (m Matches) Scale(scale float64) Matches {
-	for i := range m {
-		m[i] = m[i].Scale(scale)
-	}
-	return m
-}
-
-func (m Match) Scale(scale float64) Match {
-	m.Bounds = image.Rectangle{
-		Min: image.Point{
-			X: int(float64(m.Bounds.Min.X) * scale),
-			Y: int(float64(m.Bounds.Min.Y) * scale),
-		},
-		Max: image.Point{
-			X: int(float64(m.Bounds.Max.X) * scale),
-			Y: int(float64(m.Bounds.Max.Y) * scale),
-		},
-	}
-	return m
-}
-
-func (r Run) PrintHTML(t *template.Template) {
-	err := t.Execute(os.Stdout, r)
-	if err != nil {
-		log.Fatalf("failed to execute template: %v", err)
-	}
-}
-
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: findimg [options] <image> <subimage>\n")
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: findimg [options] <image> <subimage|dir>...\n")
+	fmt.Fprintf(w, "       findimg -batch [options] <subimage> <image|dir|glob>...\n")
+	fmt.Fprintf(w, "Any one of the images can be - to read it from the standard input.\n")
 	flag.PrintDefaults()
-	os.Exit(2)
 }
 
+// Exit statuses
+const (
+	// A match was found, scoring at least -threshold if set
+	exitFound = 0
+	// No match was found
+	exitNotFound = 1
+	// Invalid arguments or options
+	exitUsage = 2
+	// A subimage does not fit into the image
+	exitTooLarge = 3
+	// An image could not be read or decoded
+	exitIO = 4
+	// Any other error, e.g. the search timed out
+	exitError = 5
+)
+
 var (
-	output      = flag.String("o", "", "result output format (json, html, text)")
+	output      = flag.String("o", "", "result output format (json, ndjson, csv, html, png, jpeg, text)")
 	random      = flag.Bool("random", false, "randomly pick subimage as test")
 	verbose     = flag.Bool("v", false, "verbose output")
 	cpuProfile  = flag.String("cpu-profile", "", "write cpu profile to file")
@@ -85,774 +56,503 @@ var (
 	imgMaxWidth = flag.Int("img-max-width", 0, "maximum image width")
 	subMinArea  = flag.Int("sub-min-area", 0, "minimum subimage area")
 	subMaxDiv   = flag.Int("sub-max-div", 0, "maximum subimage division")
+	scaleMin    = flag.Float64("scale-min", 0, "minimum subimage scale to search, relative to its size (default 1 if -scale-max is set)")
+	scaleMax    = flag.Float64("scale-max", 0, "maximum subimage scale to search, relative to its size (default 1 if -scale-min is set)")
+	scaleStep   = flag.Float64("scale-step", 0, "maximum ratio between subsequent subimage scales searched (default 1.1)")
+	angleStep   = flag.Float64("angle-step", 0, "also search the subimage rotated by every multiple of this many degrees (e.g. 90 or 15)")
+	flip        = flag.String("flip", "", "also search the subimage mirrored (none, h, v, both)")
 	k           = flag.Int("k", 0, "number of top matches to keep")
+	nmsIoU      = flag.Float64("nms-iou", 0, "suppress matches overlapping a better match by more than this intersection over union (0-1)")
+	nmsDist     = flag.Float64("nms-dist", 0, "suppress matches closer than this many pixels to a better match")
+	threshold   = flag.Float64("threshold", 0, "return all non-overlapping matches scoring at least this, regardless of k unless set")
+	mask        = flag.String("mask", "", "mask image, black subimage pixels are ignored when matching")
+	swap        = flag.Bool("swap", false, "search for the image in the subimage instead if the subimage does not fit into it")
+	roi         = flag.String("roi", "", "only search the region x,y,w,h of the image")
+	raw         = flag.Bool("raw", false, "also report the bounds in the raw pixels of the image, before applying its EXIF orientation")
+	extract     = flag.String("extract", "", "write the region of each match to a PNG file in this directory, named by rank and score")
+	extractPad  = flag.Int("extract-pad", 0, "grow the regions written by -extract by this many pixels on every side")
+	refine      = flag.Bool("refine", false, "refine matches to pixel-exact bounds at full resolution")
+	backend     = flag.String("backend", "", "convolution backend (direct, fft)")
+	metric      = flag.String("metric", "", "match metric (sad, ssd, zncc)")
+	batch       = flag.Bool("batch", false, "search for the first image in all the following images, directories or globs")
+	jobs        = flag.Int("j", runtime.NumCPU(), "number of images searched concurrently in batch mode")
+	timeout     = flag.Duration("timeout", 0, "stop the search after this long and print the best matches so far (e.g. 500ms, 2s)")
 )
 
-type Opts struct {
-	imgMinWidth int
-	imgMaxWidth int
-	subMinArea  int
-	subMaxDiv   int
-	k           int
-	html        bool
-	verbose     bool
-	convolution bool
-	visualize   bool
-}
-
-var DEFAULT_OPTS = Opts{
-	k:           6,
-	imgMinWidth: 8,
-	imgMaxWidth: 256,
-	subMaxDiv:   64,
-	subMinArea:  5 * 5,
-	html:        false,
-	verbose:     false,
-}
-
-//go:embed templates/*.html
-var templatesFS embed.FS
-var templates struct {
-	header *template.Template
-	footer *template.Template
-	run    *template.Template
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
 }
-var templatesOnce sync.Once
 
-func main() {
+// run runs findimg with the command line arguments args, writes the results
+// to stdout and returns the exit status, so that the deferred calls run
+// before exiting.
+func run(args []string, stdout io.Writer) int {
 	log.SetFlags(0)
 	log.SetPrefix("findimg: ")
 
+	flag.CommandLine.Init("findimg", flag.ContinueOnError)
 	flag.Usage = usage
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitFound
+		}
+		return exitUsage
+	}
 
 	imgPath := flag.Arg(0)
-	subimgPath := flag.Arg(1)
+	var subimgPaths []string
+	if flag.NArg() > 1 {
+		subimgPaths = flag.Args()[1:]
+	}
 
-	if imgPath == "" || (subimgPath == "" && !*random) {
+	if imgPath == "" || (len(subimgPaths) == 0 && !*random) {
 		usage()
+		return exitUsage
+	}
+
+	if !validOutput(*output) {
+		return errorf(exitUsage, "unknown output format %q", *output)
+	}
+
+	if *extractPad < 0 {
+		return errorf(exitUsage, "-extract-pad must not be negative")
+	}
+
+	stdin := 0
+	for _, path := range append(flag.Args(), *mask) {
+		if path == stdinPath {
+			stdin++
+		}
+	}
+	if stdin > 1 {
+		return errorf(exitUsage, "only one image can be read from the standard input")
 	}
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
-			log.Fatal(err)
+			return errorf(exitIO, "failed to create cpu profile: %v", err)
 		}
 		defer f.Close()
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal(err)
+			return errorf(exitError, "failed to start cpu profile: %v", err)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
+	if *batch {
+		return runBatch(stdout, imgPath, subimgPaths)
+	}
+
 	// Open the input images
-	imgsrc, err := openImage(imgPath)
+	frames, orientation, err := openFrames(imgPath)
 	if err != nil {
-		log.Fatalf("failed to open image: %v", err)
+		return errorf(exitIO, "failed to open image: %v", err)
 	}
+	imgsrc := frames[0]
+	animated := len(frames) > 1
 
-	var subsrc image.Image
+	var needles []match.Needle
 	if *random {
-		subsrc = randomSubimage(imgsrc)
-	} else {
-		subsrc, err = openImage(subimgPath)
-		if err != nil {
-			log.Fatalf("failed to open image: %v", err)
-		}
-	}
-
-	opts := Opts{}
-	opts.html = *output == "html"
-	opts.verbose = *verbose
-	opts.imgMinWidth = *imgMinWidth
-	opts.imgMaxWidth = *imgMaxWidth
-	opts.subMinArea = *subMinArea
-	opts.subMaxDiv = *subMaxDiv
-	opts.k = *k
-
-	if opts.html {
-		opts.convolution = true
-		opts.visualize = true
-	}
-
-	matches := findImage(imgsrc, subsrc, opts)
-
-	switch *output {
-	case "json":
-		json.NewEncoder(os.Stdout).Encode(struct {
-			Matches Matches `json:"matches"`
-		}{
-			Matches: matches,
+		needles = append(needles, match.Needle{
+			Name:  "random",
+			Image: randomSubimage(imgsrc),
 		})
-	case "html":
-	default:
-		for _, match := range matches {
-			fmt.Printf(
-				"%6f %4d %4d %4d %4d\n",
-				match.Match,
-				match.Bounds.Min.X,
-				match.Bounds.Min.Y,
-				match.Bounds.Dx(),
-				match.Bounds.Dy(),
-			)
-		}
-	}
-}
-
-func findImage(imgsrc image.Image, subsrc image.Image, opts Opts) []Match {
-
-	if opts.imgMinWidth == 0 {
-		opts.imgMinWidth = DEFAULT_OPTS.imgMinWidth
 	}
 
-	if opts.imgMaxWidth == 0 {
-		opts.imgMaxWidth = DEFAULT_OPTS.imgMaxWidth
+	// Several subimages or a directory of them are output grouped by name
+	many := len(subimgPaths) > 1
+	for _, path := range subimgPaths {
+		paths, dir, err := expandDir(path)
+		if err != nil {
+			return errorf(exitIO, "failed to read subimages: %v", err)
+		}
+		many = many || dir
+		for _, path := range paths {
+			subsrc, err := openImage(path)
+			if err != nil {
+				return errorf(exitIO, "failed to open image: %v", err)
+			}
+			needles = append(needles, match.Needle{
+				Name:  path,
+				Image: subsrc,
+			})
+		}
 	}
 
-	if opts.subMinArea == 0 {
-		opts.subMinArea = DEFAULT_OPTS.subMinArea
+	if len(needles) == 0 {
+		return errorf(exitIO, "no subimages found")
 	}
 
-	if opts.subMaxDiv == 0 {
-		opts.subMaxDiv = DEFAULT_OPTS.subMaxDiv
+	if many && imageOutput() {
+		return errorf(exitUsage, "%s output requires a single subimage", *output)
 	}
 
-	if opts.k == 0 {
-		opts.k = DEFAULT_OPTS.k
+	if *mask != "" {
+		if len(needles) != 1 {
+			return errorf(exitUsage, "-mask requires a single subimage")
+		}
+		maskimg, err := openImage(*mask)
+		if err != nil {
+			return errorf(exitIO, "failed to open mask: %v", err)
+		}
+		needles[0].Image = match.ApplyMask(needles[0].Image, maskimg)
 	}
 
-	if imgsrc.Bounds().Max.X < opts.imgMaxWidth {
-		opts.imgMaxWidth = imgsrc.Bounds().Max.X
+	opts, err := matchOptions()
+	if err != nil {
+		return errorf(exitUsage, "%v", err)
 	}
-
-	templatesOnce.Do(func() {
-		funcs := template.FuncMap{
-			"imgsrc": func(img image.Image) template.URL {
-				if img == nil {
-					return template.URL("")
-				}
-				return template.URL(fmt.Sprintf("data:image/png;base64,%s", pngb64(img)))
-			},
-			"dim": func(img image.Image) string {
-				if img == nil {
-					return "0x0"
-				}
-				bounds := img.Bounds()
-				return fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy())
-			},
-			"probalpha": func(prob float64) float64 {
-				return math.Max(0, 1-(1-prob)*10)
-			},
-		}
-
-		templates.run = template.Must(template.
-			New("run.html").
-			Funcs(funcs).
-			ParseFS(templatesFS, "templates/run.html"),
-		)
-
-		templates.header = template.Must(template.
-			New("header.html").
-			Funcs(funcs).
-			ParseFS(templatesFS, "templates/header.html"),
-		)
-
-		templates.footer = template.Must(template.
-			New("footer.html").
-			Funcs(funcs).
-			ParseFS(templatesFS, "templates/footer.html"),
-		)
-	})
-
-	if opts.html {
-		templates.header.Execute(os.Stdout, struct {
-			Image    image.Image
-			Subimage image.Image
-		}{
-			Image:    imgsrc,
-			Subimage: subsrc,
-		})
+	if *output == "html" {
+		opts.HTML = stdout
 	}
 
-	var matches []Match
+	ctx, cancel := searchContext()
+	defer cancel()
 
-	for imgWidth := opts.imgMinWidth; imgWidth <= opts.imgMaxWidth; imgWidth *= 2 {
-		img := resizeImage(imgsrc, imgWidth, 0)
-		imgHeight := img.Bounds().Max.Y
-		imgScale := float64(imgWidth) / float64(imgsrc.Bounds().Max.X)
-
-		lastTopMatch := 0.0
-
-		run := Run{
-			Size: image.Point{X: imgWidth, Y: imgHeight},
+	if many {
+		start := time.Now()
+		results, err := findMany(ctx, frames, needles, opts)
+		elapsed := time.Since(start)
+		timedOut := errors.Is(err, context.DeadlineExceeded)
+		if err != nil && !timedOut {
+			return errorf(exitCode(err), "failed to find images: %v", err)
 		}
 
-		done := false
-
-		for div := 1; div <= opts.subMaxDiv; div *= 2 {
-			sscale := 1.0 / float64(div)
-			sw := int(math.Round(float64(subsrc.Bounds().Dx()) * sscale * imgScale))
-			sh := int(math.Round(float64(subsrc.Bounds().Dy()) * sscale * imgScale))
-			sarea := sw * sh
-			if sarea < opts.subMinArea || sw >= imgWidth || sh >= imgHeight {
-				if opts.verbose {
-					log.Printf("image size: %dx%d, subimage size: %dx%d, div: %d, skipping\n", imgWidth, imgHeight, sw, sh, div)
-				}
-				break
+		// Found only if all of the subimages are found
+		status := exitFound
+		for _, r := range results {
+			if r.Err != nil && !errors.Is(r.Err, match.ErrNoMatches) {
+				log.Printf("failed to find %s: %v", r.Name, r.Err)
 			}
-
-			subimg := resizeImage(subsrc, sw, sh)
-			subrun := Subrun{
-				Image:    img,
-				Subimage: subimg,
-			}
-
-			if opts.convolution {
-				subrun.Convolution = convolutionParallel(img, subimg)
+			if code := exitCode(r.Err); code > status {
+				status = code
 			}
+		}
 
-			divMatches := convolutionTopKParallel(img, subimg, opts.k)
-			if len(divMatches) == 0 {
-				subrun.Skipped = true
-				subrun.Reason = "no matches"
-				run.Subruns = append(run.Subruns, subrun)
-				break
+		if *raw {
+			for _, r := range results {
+				r.Matches.Orient(orientation, imgsrc.Bounds().Size())
 			}
-
-			divTopMatch := divMatches[0]
-			if opts.verbose {
-				log.Printf("image size: %dx%d, subimage size: %dx%d, div: %d, match: %f %v\n", imgWidth, imgHeight, sw, sh, div, divTopMatch.Match, divTopMatch.Bounds)
+		}
+		if *extract != "" {
+			for i, r := range results {
+				err := extractMatches(extractPrefix(i, len(results), r.Name), frames, needles[i].Image, r.Matches)
+				if err != nil {
+					return errorf(exitIO, "failed to extract matches: %v", err)
+				}
 			}
-			if opts.visualize {
-				subrun.Visualized = visualizeMatches(img, divMatches)
+		}
+		if recordOutput() {
+			var records []record
+			for _, r := range results {
+				records = append(records, newRecords(imgPath, r.Name, r.Matches, elapsed)...)
 			}
-
-			subrun.Matches = divMatches.Scale(1 / imgScale)
-			run.Subruns = append(run.Subruns, subrun)
-
-			if divTopMatch.Match < lastTopMatch {
-				run.Subruns[len(run.Subruns)-2].Selected = true
-				done = true
-				break
+			if err := newRecordWriter(stdout, *output, *raw).write(records); err != nil {
+				return errorf(exitIO, "failed to write results: %v", err)
 			}
-			lastTopMatch = divTopMatch.Match
-			matches = divMatches
+		} else {
+			printResults(stdout, results, animated)
 		}
 
-		if opts.html {
-			run.PrintHTML(templates.run)
-		}
-
-		if done {
-			break
+		if timedOut {
+			log.Printf("search timed out after %v, matches are partial", *timeout)
+			return exitError
 		}
+		return status
 	}
 
-	if opts.html {
-		templates.footer.Execute(os.Stdout, nil)
+	start := time.Now()
+	var matches match.Matches
+	if animated {
+		matches, err = match.FindFrames(ctx, frames, needles[0].Image, opts)
+	} else {
+		matches, err = match.Find(ctx, imgsrc, needles[0].Image, opts)
 	}
-
-	return matches
-}
-
-func randomSubimage(img image.Image) image.Image {
-	bounds := img.Bounds()
-	w := bounds.Max.X
-	h := bounds.Max.Y
-	x := rand.Intn(w)
-	y := rand.Intn(h)
-	sw := rand.Intn(w-x) + 1
-	sh := rand.Intn(h-y) + 1
-	subimg := image.NewRGBA(image.Rect(0, 0, sw, sh))
-	draw.Draw(subimg, subimg.Bounds(), img, image.Point{x, y}, draw.Src)
-	return subimg
-}
-
-func visualizeMatches(img image.Image, matches []Match) image.Image {
-	// Print points as rectangles of needle size
-	output := image.NewRGBA(img.Bounds())
-	draw.DrawMask(
-		output, output.Bounds(),
-		img, image.Point{},
-		&image.Uniform{color.Alpha{20}}, image.Point{},
-		draw.Over,
-	)
-
-	for i := len(matches) - 1; i >= 0; i-- {
-		m := matches[i]
-
-		// Calculate the color based on match
-		v := 1 - math.Min(1, (1-m.Match)*10)
-		red := uint8(255 * (1 - v))
-		green := uint8(255)
-		blue := uint8(255 * (1 - v))
-		color := color.RGBA{red, green, blue, 255}
-		draw.Draw(output, m.Bounds, &image.Uniform{color}, image.Point{}, draw.Src)
-	}
-	return output
-}
-
-func pngb64(img image.Image) string {
-	// Encode the image
-	buffer := new(bytes.Buffer)
-	err := png.Encode(buffer, img)
-	if err != nil {
-		log.Fatalf("failed to encode image: %v", err)
+	elapsed := time.Since(start)
+	if errors.Is(err, match.ErrNeedleTooLarge) {
+		return errorf(exitTooLarge, "failed to find image: %v, see -swap", err)
+	}
+	timedOut := errors.Is(err, context.DeadlineExceeded)
+	if err != nil && !timedOut && !errors.Is(err, match.ErrNoMatches) {
+		return errorf(exitCode(err), "failed to find image: %v", err)
 	}
 
-	// Convert the bytes buffer to a base64 string
-	encoded := base64.StdEncoding.EncodeToString(buffer.Bytes())
-
-	return encoded
-}
-
-func convolution(targetImage image.Image, needleImage image.Image) image.Image {
-	// Iterate over the target image and find the closest matches
-	targetBounds := targetImage.Bounds()
-	needleBounds := needleImage.Bounds()
-	outputImage := image.NewRGBA(targetBounds)
-	targetBounds.Max.X -= needleBounds.Max.X
-	targetBounds.Max.Y -= needleBounds.Max.Y
-	nw := needleBounds.Max.X
-	nh := needleBounds.Max.Y
-	narea := uint32(nw * nh)
-	for y := targetBounds.Min.Y; y < targetBounds.Max.Y; y++ {
-		for x := targetBounds.Min.X; x < targetBounds.Max.X; x++ {
-			sum := sumOfAbsDiff(targetImage, x, y, needleImage)
-			out := uint8(sum / uint32(3) / narea)
-			out = 255 - out
-			outputImage.Set(x, y, color.RGBA{out, out, out, 255})
+	if *raw {
+		matches.Orient(orientation, imgsrc.Bounds().Size())
+	}
+	if *extract != "" {
+		if err := extractMatches("", frames, needles[0].Image, matches); err != nil {
+			return errorf(exitIO, "failed to extract matches: %v", err)
 		}
 	}
-	return outputImage
-}
-
-func convolutionParallel(img *image.RGBA, subimg *image.RGBA) image.Image {
-	imgr := img.Bounds()
-	subimgr := subimg.Bounds()
-	outputImage := image.NewRGBA(imgr)
-
-	imgr.Max.X -= subimgr.Max.X
-	imgr.Max.Y -= subimgr.Max.Y
-
-	nw := subimgr.Max.X
-	nh := subimgr.Max.Y
-
-	wg := sync.WaitGroup{}
-
-	// Define the number of workers
-	numWorkers := runtime.NumCPU() * 2
-
-	// Calculate the height of each horizontal slice
-	sliceHeight := imgr.Dy() / numWorkers
-
-	norm := 1 / float64(nw*nh*3)
-
-	// Launch workers
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			// Calculate the bounds for the current worker
-			ya := workerID * sliceHeight
-			yb := ya + sliceHeight
-			// Make sure the last slice goes till the edge
-			if workerID == numWorkers-1 {
-				yb = imgr.Max.Y
-			}
-
-			xb := imgr.Max.X
-
-			// Iterate over the target image slice
-			for y := ya; y < yb; y++ {
-				for x := 0; x < xb; x++ {
-					// Perform the convolution operation
-					sum := sumOfAbsDiffRGBA(img, x, y, subimg)
-					out := 255 - uint8(float64(sum)*norm)
-					outputImage.Set(x, y, color.RGBA{out, out, out, 255})
-				}
-			}
-
-			// Signal that the worker has finished
-			wg.Done()
-		}(i)
+	switch {
+	case imageOutput():
+		if err := writeAnnotated(stdout, frames, needles[0].Image, matches); err != nil {
+			return errorf(exitIO, "failed to write image: %v", err)
+		}
+	case recordOutput():
+		records := newRecords(imgPath, needles[0].Name, matches, elapsed)
+		if err := newRecordWriter(stdout, *output, *raw).write(records); err != nil {
+			return errorf(exitIO, "failed to write results: %v", err)
+		}
+	default:
+		printMatches(stdout, matches, animated)
 	}
 
-	// Wait for all workers to finish
-	wg.Wait()
-
-	return outputImage
+	if timedOut {
+		log.Printf("search timed out after %v, matches are partial", *timeout)
+		return exitError
+	}
+	return exitCode(err)
 }
 
-func sumOfAbsDiff(img image.Image, x int, y int, subimg image.Image) uint32 {
-	sum := uint32(0)
-	b := subimg.Bounds()
-	w := b.Dx()
-	h := b.Dy()
-
-	for ny := 0; ny < h; ny++ {
-		for nx := 0; nx < w; nx++ {
-			t := img.At(x+nx, y+ny)
-			n := subimg.At(b.Min.X+nx, b.Min.Y+ny)
-			sum += rgbAbsSum(t, n)
-		}
+// findMany searches for all the needles in the frames. A single frame is
+// resized only once for all of the needles, every frame of an animated
+// image is searched for each needle separately.
+func findMany(ctx context.Context, frames []image.Image, needles []match.Needle, opts match.Options) ([]match.Result, error) {
+	if len(frames) == 1 {
+		return match.FindMany(ctx, frames[0], needles, opts)
 	}
-	return sum
-}
 
-func sumOfAbsDiffRGBA(img *image.RGBA, x int, y int, subimg *image.RGBA) uint32 {
-	sum := uint32(0)
-	b := subimg.Bounds()
-	w := b.Dx()
-	h := b.Dy()
-
-	ipix := img.Pix
-	spix := subimg.Pix
-
-	for ny := 0; ny < h; ny++ {
-		for nx := 0; nx < w; nx++ {
-			i := img.PixOffset(x+nx, y+ny)
-			j := subimg.PixOffset(b.Min.X+nx, b.Min.Y+ny)
-			// sum += rgbAbsSumSliceBitwise(
-			// 	ipix[i:i+4:i+4],
-			// 	spix[j:j+4:j+4],
-			// )
-			sum += rgbAbsSumSliceBitwise(
-				ipix[i:i+3:i+3],
-				spix[j:j+3:j+3],
-			)
+	results := make([]match.Result, 0, len(needles))
+	for _, needle := range needles {
+		matches, err := match.FindFrames(ctx, frames, needle.Image, opts)
+		result := match.Result{
+			Name:    needle.Name,
+			Matches: matches,
 		}
+		if errors.Is(err, match.ErrNoMatches) || errors.Is(err, match.ErrNeedleTooLarge) {
+			result.Err = err
+		} else if err != nil {
+			return append(results, result), err
+		}
+		results = append(results, result)
 	}
-	return sum
+	return results, nil
 }
 
-type Match struct {
-	Bounds image.Rectangle `json:"bounds"`
-	Match  float64         `json:"match"`
+// exitCode returns the exit status for an error returned by the match
+// package.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitFound
+	case errors.Is(err, match.ErrNoMatches):
+		return exitNotFound
+	case errors.Is(err, match.ErrNeedleTooLarge):
+		return exitTooLarge
+	case errors.Is(err, match.ErrInvalidScale),
+		errors.Is(err, match.ErrInvalidWidth),
+		errors.Is(err, match.ErrInvalidAngle),
+		errors.Is(err, match.ErrInvalidFlip),
+		errors.Is(err, match.ErrInvalidMetric),
+		errors.Is(err, match.ErrInvalidBackend),
+		errors.Is(err, match.ErrInvalidROI):
+		return exitUsage
+	default:
+		return exitError
+	}
 }
 
-func (m Match) MarshalJSON() ([]byte, error) {
-	type Bounds struct {
-		X int `json:"x"`
-		Y int `json:"y"`
-		W int `json:"w"`
-		H int `json:"h"`
-	}
-	return json.Marshal(struct {
-		Bounds Bounds  `json:"bounds"`
-		Match  float64 `json:"match"`
-	}{
-		Bounds: Bounds{
-			X: m.Bounds.Min.X,
-			Y: m.Bounds.Min.Y,
-			W: m.Bounds.Dx(),
-			H: m.Bounds.Dy(),
-		},
-		Match: m.Match,
-	})
+// errorf logs the message and returns status code, for run to return it
+// after its deferred calls.
+func errorf(code int, format string, v ...any) int {
+	log.Printf(format, v...)
+	return code
 }
 
-func convolutionTopK(img *image.RGBA, subimg *image.RGBA, k int) Matches {
-	// Iterate over the target image and find the closest matches
-	imgr := img.Bounds()
-	subimgr := subimg.Bounds()
-	subw := subimgr.Dx()
-	subh := subimgr.Dy()
-
-	inner := image.Rect(
-		imgr.Min.X,
-		imgr.Min.Y,
-		imgr.Max.X-subw,
-		imgr.Max.Y-subh,
-	)
-
-	var matches []Match
-	var minSums []uint32
-	// totalSum := 0.
-
-	for y := inner.Min.Y; y < inner.Max.Y; y++ {
-		for x := inner.Min.X; x < inner.Max.X; x++ {
-			// Loop over needle
-			// sum := uint32(0)
-			sum := sumOfAbsDiffRGBA(img, x, y, subimg)
-			// for ny := subimgr.Min.Y; ny < subimgr.Max.Y; ny++ {
-			// 	for nx := subimgr.Min.X; nx < subimgr.Max.X; nx++ {
-			// 		// Multiply corresponding pixels
-			// 		targetPixel := img.At(x+nx, y+ny)
-			// 		needlePixel := subimg.At(nx, ny)
-			// 		// Pixel diff
-			// 		sum += rgbAbsSum(targetPixel, needlePixel)
-			// 	}
-			// }
-
-			// totalSum += float64(sum)
-			bounds := image.Rect(x, y, x+subw, y+subh)
-
-			// Check if the current match is one of the top k matches
-			if len(matches) < k {
-				matches = append(matches, Match{Bounds: bounds, Match: float64(sum)})
-				minSums = append(minSums, sum)
-			} else {
-				maxDiffIndex := 0
-				for i := 1; i < k; i++ {
-					if minSums[i] > minSums[maxDiffIndex] {
-						maxDiffIndex = i
-					}
-				}
-				if sum < minSums[maxDiffIndex] {
-					matches[maxDiffIndex] = Match{Bounds: bounds, Match: float64(sum)}
-					minSums[maxDiffIndex] = sum
-				}
-			}
+func matchOptions() (match.Options, error) {
+	opts := match.Options{}
+	opts.Verbose = *verbose
+	opts.ImageMinWidth = *imgMinWidth
+	opts.ImageMaxWidth = *imgMaxWidth
+	opts.SubimageMinArea = *subMinArea
+	opts.SubimageMaxDiv = *subMaxDiv
+	opts.ScaleMin = *scaleMin
+	opts.ScaleMax = *scaleMax
+	opts.ScaleStep = *scaleStep
+	opts.AngleStep = *angleStep
+	opts.Flip = match.Flip(*flip)
+	opts.K = *k
+	opts.Backend = match.Backend(*backend)
+	opts.Metric = match.Metric(*metric)
+	opts.NMSIoU = *nmsIoU
+	opts.NMSDistance = *nmsDist
+	opts.Threshold = *threshold
+	opts.Refine = *refine
+	opts.Swap = *swap
+	if *roi != "" {
+		r, err := parseRect(*roi)
+		if err != nil {
+			return opts, fmt.Errorf("invalid -roi: %w", err)
 		}
+		opts.ROI = r
 	}
-
-	norm := 1 / float64(subimgr.Max.X*subimgr.Max.Y*0xFF*3)
-	for i := 0; i < len(matches); i++ {
-		matches[i].Match = 1 - matches[i].Match*norm
-	}
-
-	sort.Slice(matches, func(i, j int) bool {
-		return matches[i].Match > matches[j].Match
-	})
-
-	return matches
+	return opts, nil
 }
 
-func convolutionTopKParallel(img *image.RGBA, subimg *image.RGBA, k int) Matches {
-	// Iterate over the target image and find the closest matches
-	imgr := img.Bounds()
-	subimgr := subimg.Bounds()
-	subw := subimgr.Dx()
-	subh := subimgr.Dy()
-
-	inner := image.Rect(
-		imgr.Min.X,
-		imgr.Min.Y,
-		imgr.Max.X-subw,
-		imgr.Max.Y-subh,
-	)
-
-	if k < 1 {
-		k = 1
-	}
-
-	numWorkers := runtime.NumCPU() * 2
-	sliceHeight := inner.Dy() / numWorkers
-	wg := sync.WaitGroup{}
-	matchChan := make(chan Match)
-
-	// Launch workers
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			// Calculate the bounds for the current worker
-			ya := inner.Min.Y + workerID*sliceHeight
-			yb := ya + sliceHeight
-			// Make sure the last slice goes till the edge
-			if workerID == numWorkers-1 {
-				yb = inner.Dy()
-			}
-
-			xa := inner.Min.X
-			xb := inner.Max.X
-
-			var matches []Match
-			var minSums []uint32
-			// totalSum := 0.
-
-			// Iterate over the target image slice
-			for y := ya; y < yb; y++ {
-				for x := xa; x < xb; x++ {
-					// Perform the convolution operation
-					sum := sumOfAbsDiffRGBA(img, x, y, subimg)
-					bounds := image.Rect(x, y, x+subw, y+subh)
-
-					// Check if the current match is one of the top k matches
-					if len(matches) < k {
-						matches = append(matches, Match{Bounds: bounds, Match: float64(sum)})
-						minSums = append(minSums, sum)
-					} else {
-						maxDiffIndex := 0
-						for i := 1; i < k; i++ {
-							if minSums[i] > minSums[maxDiffIndex] {
-								maxDiffIndex = i
-							}
-						}
-						if sum < minSums[maxDiffIndex] {
-							matches[maxDiffIndex] = Match{Bounds: bounds, Match: float64(sum)}
-							minSums[maxDiffIndex] = sum
-						}
-					}
-				}
-			}
-
-			// Send the matches to the channel
-			for _, match := range matches {
-				matchChan <- match
-			}
-
-			// Signal that the worker has finished
-			wg.Done()
-		}(i)
+// parseRect parses a rectangle in the x,y,w,h format.
+func parseRect(s string) (image.Rectangle, error) {
+	var x, y, w, h int
+	if _, err := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); err != nil {
+		return image.Rectangle{}, fmt.Errorf("expected x,y,w,h: %w", err)
 	}
-
-	// Wait for all workers to finish and close the channel
-	go func() {
-		wg.Wait()
-		close(matchChan)
-	}()
-
-	// Create a slice to store the matches
-	matches := make([]Match, 0, k*numWorkers)
-
-	// Read matches from the channel
-	for match := range matchChan {
-		matches = append(matches, match)
+	if w <= 0 || h <= 0 {
+		return image.Rectangle{}, fmt.Errorf("empty rectangle %dx%d", w, h)
 	}
-
-	// Sort the matches
-	sort.Slice(matches, func(i, j int) bool {
-		// These are not matches, but rather the sum of absolute differences,
-		// so we need to sort them in reverse order.
-		return matches[i].Match < matches[j].Match
-	})
-
-	// Keep only the top k matches
-	matches = matches[:k]
-
-	// Normalize
-	norm := 1 / float64(subimgr.Max.X*subimgr.Max.Y*0xFF*3)
-	for i := 0; i < len(matches); i++ {
-		matches[i].Match = 1 - matches[i].Match*norm
-	}
-
-	return matches
+	return image.Rect(x, y, x+w, y+h), nil
 }
 
-func rgbAbsSum(a, b color.Color) uint32 {
-	ar, ag, ab, _ := a.RGBA()
-	br, bg, bb, _ := b.RGBA()
-	var dr, dg, db uint32
-	if ar > br {
-		dr = ar - br
-	} else {
-		dr = br - ar
+// searchContext returns the context limiting the search to -timeout.
+func searchContext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
 	}
-	if ag > bg {
-		dg = ag - bg
-	} else {
-		dg = bg - ag
-	}
-	if ab > bb {
-		db = ab - bb
-	} else {
-		db = bb - ab
-	}
-	return (dr + dg + db) / 0xFF
+	return context.WithCancel(context.Background())
 }
 
-func rgbAbsSumSlice(a, b []uint8) uint32 {
-	ar, ag, ab := a[0], a[1], a[2]
-	br, bg, bb := b[0], b[1], b[2]
-	var dr, dg, db uint8
-	if ar > br {
-		dr = ar - br
-	} else {
-		dr = br - ar
-	}
-	if ag > bg {
-		dg = ag - bg
-	} else {
-		dg = bg - ag
-	}
-	if ab > bb {
-		db = ab - bb
-	} else {
-		db = bb - ab
+func printMatches(w io.Writer, matches match.Matches, animated bool) {
+	switch *output {
+	case "json":
+		json.NewEncoder(w).Encode(struct {
+			Matches match.Matches `json:"matches"`
+		}{
+			Matches: matches,
+		})
+	case "html":
+	default:
+		printText(w, matches, animated)
 	}
-	return uint32(dr) + uint32(dg) + uint32(db)
 }
 
-func bitwiseAbsDiff(a, b uint8) uint32 {
-	v := int32(a) - int32(b)
-	m := v >> (32 - 1)
-	return uint32((v + m) ^ m)
+func printResults(w io.Writer, results []match.Result, animated bool) {
+	switch *output {
+	case "json":
+		json.NewEncoder(w).Encode(struct {
+			Needles []match.Result `json:"needles"`
+		}{
+			Needles: results,
+		})
+	case "html":
+	default:
+		for i, r := range results {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "==> %s <==\n", r.Name)
+			printText(w, r.Matches, animated)
+		}
+	}
 }
 
-func rgbAbsSumSliceBitwise(a, b []uint8) uint32 {
-	return bitwiseAbsDiff(a[0], b[0]) + bitwiseAbsDiff(a[1], b[1]) + bitwiseAbsDiff(a[2], b[2])
+// validOutput returns whether format is one of the -o output formats, the
+// empty one being text.
+func validOutput(format string) bool {
+	switch format {
+	case "", "text", "json", "ndjson", "csv", "html", "png", "jpeg":
+		return true
+	}
+	return false
 }
 
-func multiplyPixels(pixel1 color.Color, pixel2 color.Color) color.Color {
-	r1, g1, b1, a1 := pixel1.RGBA()
-	r2, g2, b2, a2 := pixel2.RGBA()
-	r := uint8((r1 * r2) >> 8)
-	g := uint8((g1 * g2) >> 8)
-	b := uint8((b1 * b2) >> 8)
-	a := uint8((a1 * a2) >> 8)
-	return color.RGBA{r, g, b, a}
+// imageOutput returns whether the output is an annotated image.
+func imageOutput() bool {
+	return *output == "png" || *output == "jpeg"
 }
 
-func calculateMeanColor(img image.Image) color.Color {
-	bounds := img.Bounds()
-	var r, g, b, a uint32
-	var count uint32
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixel := img.At(x, y)
-			pr, pg, pb, pa := pixel.RGBA()
-			r += pr
-			g += pg
-			b += pb
-			a += pa
-			count++
+// writeAnnotated writes the image the matches were found in annotated with
+// them to w, which is the subimage if they are swapped or the frame of the
+// best match if the image is animated.
+func writeAnnotated(w io.Writer, frames []image.Image, subsrc image.Image, matches match.Matches) error {
+	img := frames[0]
+	if len(matches) > 0 {
+		img = sourceImage(frames, subsrc, matches[0])
+		var inFrame match.Matches
+		for _, m := range matches {
+			if m.Frame == matches[0].Frame {
+				inFrame = append(inFrame, m)
+			}
 		}
+		matches = inFrame
 	}
 
-	r /= count
-	g /= count
-	b /= count
-	a /= count
-
-	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
-}
-
-func openImage(filename string) (image.Image, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+	annotated := match.Annotate(img, matches)
+	if *output == "jpeg" {
+		return jpeg.Encode(w, annotated, &jpeg.Options{Quality: 90})
 	}
-	defer file.Close()
+	return png.Encode(w, annotated)
+}
 
-	img, _, err := image.Decode(file)
-	if err != nil {
-		return nil, err
+// printText prints a line per match to w, followed by the raw bounds if set
+// and with the frame index as the last column if the image is animated.
+func printText(w io.Writer, matches match.Matches, animated bool) {
+	for _, m := range matches {
+		fmt.Fprintf(
+			w,
+			"%6f %4d %4d %4d %4d",
+			m.Match,
+			m.Bounds.Min.X,
+			m.Bounds.Min.Y,
+			m.Bounds.Dx(),
+			m.Bounds.Dy(),
+		)
+		if !m.RawBounds.Empty() {
+			fmt.Fprintf(
+				w,
+				" %4d %4d %4d %4d",
+				m.RawBounds.Min.X,
+				m.RawBounds.Min.Y,
+				m.RawBounds.Dx(),
+				m.RawBounds.Dy(),
+			)
+		}
+		if animated {
+			fmt.Fprintf(w, " %4d", m.Frame)
+		}
+		fmt.Fprintln(w)
 	}
-
-	return img, nil
 }
 
-func resizeImage(img image.Image, width, height int) *image.RGBA {
+func randomSubimage(img image.Image) image.Image {
 	bounds := img.Bounds()
-	imgWidth := bounds.Max.X - bounds.Min.X
-	imgHeight := bounds.Max.Y - bounds.Min.Y
+	w := bounds.Dx()
+	h := bounds.Dy()
+	x := rand.Intn(w)
+	y := rand.Intn(h)
+	sw := rand.Intn(w-x) + 1
+	sh := rand.Intn(h-y) + 1
+	subimg := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(subimg, subimg.Bounds(), img, bounds.Min.Add(image.Point{x, y}), draw.Src)
+	return subimg
+}
 
-	if width == 0 {
-		width = int(float64(height) * float64(imgWidth) / float64(imgHeight))
-	} else if height == 0 {
-		height = int(float64(width) * float64(imgHeight) / float64(imgWidth))
+// expandDir returns the image files in path if it is a directory, sorted by
+// name, or path itself otherwise.
+func expandDir(path string) (paths []string, dir bool, err error) {
+	if path == stdinPath {
+		return []string{path}, false, nil
 	}
-
-	if width < 1 {
-		width = 1
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
 	}
-
-	if height < 1 {
-		height = 1
+	if !info.IsDir() {
+		return []string{path}, false, nil
 	}
 
-	resized := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Over, nil)
-	return resized
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, true, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".bmp", ".tif", ".tiff":
+			paths = append(paths, filepath.Join(path, e.Name()))
+		}
+	}
+	return paths, true, nil
 }
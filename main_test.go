@@ -1,275 +1,64 @@
 package main
 
 import (
-	"image"
-	"math/rand"
+	"bytes"
+	"flag"
+	"io"
+	"strings"
 	"testing"
-
-	"golang.org/x/image/draw"
 )
 
-func createSubImage(img image.Image, r image.Rectangle) image.Image {
-	subimg := image.NewRGBA(r)
-	draw.Draw(subimg, r, img, r.Min, draw.Src)
-	return subimg
-}
-
-func TestFindImage(t *testing.T) {
-	// Create test images
-	imgsrc, err := openImage("test/img/haystack2.jpg")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	rect := image.Rect(66, 287, 121, 327)
-
-	subsrc := createSubImage(imgsrc, rect)
-
-	// Define test options
-	opts := Opts{
-		imgMinWidth: 8,
-		imgMaxWidth: 128,
-		subMinArea:  5 * 5,
-		verbose:     true,
-	}
-
-	// Find image
-	matches := findImage(imgsrc, subsrc, opts)
-	if err != nil {
-		t.Error(err)
-	}
-
-	// Check results
-	if len(matches) < 1 {
-		t.Fatal("No matches found")
-	}
-
-	itr := matches[0].Bounds.Intersect(rect)
-	if itr.Empty() {
-		t.Fatal("No intersection found")
-	}
-
-	if itr.Dx() < 5 || itr.Dy() < 5 {
-		t.Fatal("Intersection too small")
-	}
-
-	println("Found match:", matches[0].Bounds.String())
-}
-
-func TestFindImageRandom(t *testing.T) {
-	// Create test images
-	imgsrc, err := openImage("test/img/haystack2.jpg")
-	if err != nil {
-		t.Fatal(err)
-	}
-	bounds := imgsrc.Bounds()
-	w := bounds.Dx()
-	h := bounds.Dy()
-
-	rnd := rand.New(rand.NewSource(0))
-
-	for i := 0; i < 10; i++ {
-		// Create random rectangle
-		x := rnd.Intn(w - 1)
-		y := rnd.Intn(h - 1)
-		sw := rnd.Intn(w-1-x) + 1
-		sh := rnd.Intn(h-1-y) + 1
-		rect := image.Rect(x, y, x+sw, y+sh)
-
-		subsrc := createSubImage(imgsrc, rect)
-
-		// Define test options
-		opts := Opts{
-			imgMinWidth: 8,
-			imgMaxWidth: 128,
-			subMinArea:  5 * 5,
-			k:           1,
-			verbose:     true,
-		}
-
-		// Find image
-		matches := findImage(imgsrc, subsrc, opts)
-		if err != nil {
-			t.Error(err)
-			continue
-		}
-
-		// Check results
-		if len(matches) < 1 {
-			t.Error("No matches found")
-			continue
-		}
-
-		itr := matches[0].Bounds.Intersect(rect)
-		if itr.Empty() {
-			t.Errorf("No intersection found: %s", matches[0].Bounds.String())
-			continue
-		}
-
-		if itr.Dx() < 5 || itr.Dy() < 5 {
-			t.Error("Intersection too small")
-			continue
-		}
-		println("Found match:", matches[0].Bounds.String())
-	}
-}
-
-func TestFindImageRandomPatches(t *testing.T) {
-	// Create test images
-	imgsrc, err := openImage("test/img/haystack2.jpg")
-	if err != nil {
-		t.Fatal(err)
-	}
-	bounds := imgsrc.Bounds()
-	w := bounds.Dx()
-	h := bounds.Dy()
-
-	rnd := rand.New(rand.NewSource(0))
-
-	for i := 0; i < 30; i++ {
-		// Create random rectangle
-		sw := 200
-		sh := 150
-		x := rnd.Intn(w - 1 - sw)
-		y := rnd.Intn(h - 1 - sh)
-		rect := image.Rect(x, y, x+sw, y+sh)
-
-		subsrc := createSubImage(imgsrc, rect)
-
-		// Define test options
-		opts := Opts{
-			k: 1,
-			// html:        true,
-			// convolution: true,
-			// visualize:   true,
-		}
-
-		// Find image
-		matches := findImage(imgsrc, subsrc, opts)
-		if err != nil {
-			t.Error(err)
-			continue
-		}
-
-		// Check results
-		if len(matches) < 1 {
-			t.Error("No matches found")
-			continue
-		}
-
-		itr := matches[0].Bounds.Intersect(rect)
-		if itr.Empty() {
-			t.Errorf("No intersection found: expected %s got %s", rect.String(), matches[0].Bounds.String())
-			continue
-		}
-
-		if itr.Dx() < 5 || itr.Dy() < 5 {
-			t.Error("Intersection too small")
-			continue
-		}
-		t.Log("Found match:", matches[0].Bounds.String())
+// resetFlags sets all the flags back to their defaults before and after the
+// test, as run parses them into the package globals, and hides the usage.
+// The flags of the test binary are left alone.
+func resetFlags(t *testing.T) {
+	reset := func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
 	}
+	reset()
+	flag.CommandLine.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		reset()
+		flag.CommandLine.SetOutput(nil)
+	})
 }
 
-func BenchmarkFindImageRandomPatches(b *testing.B) {
-	// Create test images
-	imgsrc, err := openImage("test/img/haystack2.jpg")
-	if err != nil {
-		b.Fatal(err)
+func TestRunExitStatus(t *testing.T) {
+	empty := t.TempDir()
+
+	tests := []struct {
+		name   string
+		args   []string
+		want   int
+		output bool
+	}{
+		{"found", []string{"assets/haystack.jpg", "assets/needle.jpg"}, exitFound, true},
+		{"not found", []string{"-threshold", "0.99", "assets/haystack.jpg", "assets/needle.jpg"}, exitNotFound, false},
+		{"no arguments", nil, exitUsage, false},
+		{"unknown output", []string{"-o", "foo", "assets/haystack.jpg", "assets/needle.jpg"}, exitUsage, false},
+		{"bad roi", []string{"-roi", "bad", "assets/haystack.jpg", "assets/needle.jpg"}, exitUsage, false},
+		{"unknown flag", []string{"-nope", "assets/haystack.jpg", "assets/needle.jpg"}, exitUsage, false},
+		{"bad widths", []string{"-img-min-width", "300", "-img-max-width", "200", "assets/haystack.jpg", "assets/needle.jpg"}, exitUsage, false},
+		{"too large", []string{"assets/needle.jpg", "assets/haystack.jpg"}, exitTooLarge, false},
+		{"missing image", []string{"assets/missing.jpg", "assets/needle.jpg"}, exitIO, false},
+		{"missing subimage", []string{"assets/haystack.jpg", "assets/missing.jpg"}, exitIO, false},
+		{"empty directory", []string{"assets/haystack.jpg", empty}, exitIO, false},
+		{"empty directory csv", []string{"-o", "csv", "assets/haystack.jpg", empty}, exitIO, false},
 	}
-	bounds := imgsrc.Bounds()
-	w := bounds.Dx()
-	h := bounds.Dy()
-
-	rnd := rand.New(rand.NewSource(0))
-
-	for i := 0; i < b.N; i++ {
-		b.StopTimer()
-
-		// Create random rectangle
-		sw := 200
-		sh := 150
-		x := rnd.Intn(w - 1 - sw)
-		y := rnd.Intn(h - 1 - sh)
-		rect := image.Rect(x, y, x+sw, y+sh)
-
-		subsrc := createSubImage(imgsrc, rect)
-
-		// Define test options
-		opts := Opts{
-			k: 1,
-		}
-
-		// Find image
-		b.StartTimer()
-		matches := findImage(imgsrc, subsrc, opts)
-		b.StopTimer()
-		if err != nil {
-			b.Error(err)
-			continue
-		}
-
-		// Check results
-		if len(matches) < 1 {
-			b.Error("No matches found")
-			continue
-		}
-
-		itr := matches[0].Bounds.Intersect(rect)
-		if itr.Empty() {
-			b.Errorf("No intersection found: expected %s got %s", rect.String(), matches[0].Bounds.String())
-			continue
-		}
-
-		if itr.Dx() < 5 || itr.Dy() < 5 {
-			b.Error("Intersection too small")
-			continue
-		}
-		b.Log("Found match:", matches[0].Bounds.String())
-	}
-}
-
-func FuzzFindImage(f *testing.F) {
-
-	// Create test images
-	imgsrc, err := openImage("test/img/haystack2.jpg")
-	if err != nil {
-		f.Fatal(err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(t)
+			var buf bytes.Buffer
+			if code := run(tt.args, &buf); code != tt.want {
+				t.Errorf("expected exit status %d, got %d", tt.want, code)
+			}
+			if got := buf.Len() > 0; got != tt.output {
+				t.Errorf("expected output %v, got:\n%s", tt.output, buf.String())
+			}
+		})
 	}
-
-	f.Add(66, 287, 121, 327)
-	f.Fuzz(func(t *testing.T, a int, b int, c int, d int) {
-		rect := image.Rect(a, b, c, d)
-
-		subsrc := createSubImage(imgsrc, rect)
-
-		// Define test options
-		opts := Opts{
-			imgMinWidth: 8,
-			imgMaxWidth: 128,
-			subMinArea:  5 * 5,
-		}
-
-		// Find image
-		matches := findImage(imgsrc, subsrc, opts)
-		if err != nil {
-			t.Error(err)
-		}
-
-		// Check results
-		if len(matches) < 1 {
-			t.Error("No matches found")
-		}
-
-		itr := matches[0].Bounds.Intersect(rect)
-		if itr.Empty() {
-			t.Error("No intersection found")
-		}
-
-		if itr.Dx() < 5 || itr.Dy() < 5 {
-			t.Error("Intersection too small")
-		}
-
-		println("Found match:", matches[0].Bounds.String())
-	})
 }
@@ -0,0 +1,104 @@
+package match
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Annotate returns a copy of img with the matches outlined in the color of
+// their score, as in the HTML output, and labeled with their rank and score.
+// The matches are in the coordinates of img, e.g. as returned by Find.
+func Annotate(img image.Image, matches []Match) *image.RGBA {
+	b := img.Bounds()
+	output := image.NewRGBA(b)
+	draw.Draw(output, b, img, b.Min, draw.Src)
+
+	// Scale the outlines and labels with the image
+	scale := b.Dx()
+	if b.Dy() < scale {
+		scale = b.Dy()
+	}
+	scale = scale/500 + 1
+
+	// Draw the best matches last, on top of the others
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		c := matchColor(m.Match)
+		polygon := m.Polygon
+		if polygon == nil {
+			r := m.Bounds
+			polygon = []Point{
+				{X: float64(r.Min.X), Y: float64(r.Min.Y)},
+				{X: float64(r.Max.X), Y: float64(r.Min.Y)},
+				{X: float64(r.Max.X), Y: float64(r.Max.Y)},
+				{X: float64(r.Min.X), Y: float64(r.Max.Y)},
+			}
+		}
+		// Outline in black first to stand out on light images
+		drawPolygon(output, polygon, color.RGBA{0, 0, 0, 255}, 2*scale+2)
+		drawPolygon(output, polygon, c, 2*scale)
+		drawLabel(output, fmt.Sprintf("#%d %.3f", i+1, m.Match), m.Bounds.Min, c, scale)
+	}
+	return output
+}
+
+// matchColor returns the color of a match score, from white for 0.9 or less
+// to green for a perfect match.
+func matchColor(match float64) color.RGBA {
+	v := 1 - math.Min(1, (1-match)*10)
+	red := uint8(255 * (1 - v))
+	green := uint8(255)
+	blue := uint8(255 * (1 - v))
+	return color.RGBA{red, green, blue, 255}
+}
+
+// drawPolygon draws the outline of a polygon with lines width pixels wide.
+func drawPolygon(img *image.RGBA, polygon []Point, c color.RGBA, width int) {
+	u := &image.Uniform{c}
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		steps := int(math.Ceil(math.Hypot(q.X-p.X, q.Y-p.Y)))
+		for s := 0; s <= steps; s++ {
+			t := float64(s) / math.Max(1, float64(steps))
+			x := int(math.Round(p.X + (q.X-p.X)*t - float64(width)/2))
+			y := int(math.Round(p.Y + (q.Y-p.Y)*t - float64(width)/2))
+			draw.Draw(img, image.Rect(x, y, x+width, y+width), u, image.Point{}, draw.Src)
+		}
+	}
+}
+
+// drawLabel draws text on a box of color c above the top left corner at, or
+// below it if there is no room, scaled up by scale.
+func drawLabel(img *image.RGBA, text string, at image.Point, c color.RGBA, scale int) {
+	face := basicfont.Face7x13
+	label := image.NewRGBA(image.Rect(0, 0, font.MeasureString(face, text).Ceil()+4, face.Height+2))
+	draw.Draw(label, label.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  label,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(2, face.Ascent+1),
+	}
+	d.DrawString(text)
+
+	b := img.Bounds()
+	size := label.Bounds().Size().Mul(scale)
+	pos := at.Sub(image.Pt(0, size.Y))
+	if pos.Y < b.Min.Y {
+		pos.Y = at.Y
+	}
+	if pos.X+size.X > b.Max.X {
+		pos.X = b.Max.X - size.X
+	}
+	if pos.X < b.Min.X {
+		pos.X = b.Min.X
+	}
+	draw.NearestNeighbor.Scale(img, image.Rectangle{pos, pos.Add(size)}, label, label.Bounds(), draw.Src, nil)
+}
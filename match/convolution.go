@@ -0,0 +1,421 @@
+package match
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+func visualizeMatches(img image.Image, matches []Match) image.Image {
+	// Print points as rectangles of needle size
+	output := image.NewRGBA(img.Bounds())
+	draw.DrawMask(
+		output, output.Bounds(),
+		img, img.Bounds().Min,
+		&image.Uniform{color.Alpha{20}}, image.Point{},
+		draw.Over,
+	)
+
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+
+		// Calculate the color based on match
+		color := matchColor(m.Match)
+		if m.Polygon == nil {
+			draw.Draw(output, m.Bounds, &image.Uniform{color}, image.Point{}, draw.Src)
+			continue
+		}
+		r := m.Bounds.Intersect(output.Bounds())
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if contains(m.Polygon, Point{X: float64(x) + 0.5, Y: float64(y) + 0.5}) {
+					output.SetRGBA(x, y, color)
+				}
+			}
+		}
+	}
+	return output
+}
+
+func convolution(targetImage image.Image, needleImage image.Image) image.Image {
+	// Iterate over the target image and find the closest matches
+	targetBounds := targetImage.Bounds()
+	needleBounds := needleImage.Bounds()
+	outputImage := image.NewRGBA(targetBounds)
+	nw := needleBounds.Dx()
+	nh := needleBounds.Dy()
+	targetBounds.Max.X -= nw
+	targetBounds.Max.Y -= nh
+	narea := uint32(nw * nh)
+	for y := targetBounds.Min.Y; y < targetBounds.Max.Y; y++ {
+		for x := targetBounds.Min.X; x < targetBounds.Max.X; x++ {
+			sum := sumOfAbsDiff(targetImage, x, y, needleImage)
+			out := uint8(sum / uint32(3) / narea)
+			out = 255 - out
+			outputImage.Set(x, y, color.RGBA{out, out, out, 255})
+		}
+	}
+	return outputImage
+}
+
+func convolutionParallel(ctx context.Context, img *image.RGBA, subimg *image.RGBA, metric Metric) (image.Image, error) {
+	imgr := img.Bounds()
+	subimgr := subimg.Bounds()
+	outputImage := image.NewRGBA(imgr)
+
+	inner := image.Rect(
+		imgr.Min.X,
+		imgr.Min.Y,
+		imgr.Max.X-subimgr.Dx(),
+		imgr.Max.Y-subimgr.Dy(),
+	)
+
+	scorer := newScorer(metric, subimg)
+
+	wg := sync.WaitGroup{}
+
+	// Define the number of workers
+	numWorkers := runtime.NumCPU() * 2
+
+	// Calculate the height of each horizontal slice
+	sliceHeight := inner.Dy() / numWorkers
+
+	// Launch workers
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			// Calculate the bounds for the current worker
+			ya := inner.Min.Y + workerID*sliceHeight
+			yb := ya + sliceHeight
+			// Make sure the last slice goes till the edge
+			if workerID == numWorkers-1 {
+				yb = inner.Max.Y
+			}
+
+			xa := inner.Min.X
+			xb := inner.Max.X
+
+			// Iterate over the target image slice
+			for y := ya; y < yb; y++ {
+				if ctx.Err() != nil {
+					break
+				}
+				for x := xa; x < xb; x++ {
+					// Perform the convolution operation
+					score := scorer.score(img, x, y)
+					out := uint8(math.Max(0, math.Min(1, score)) * 255)
+					outputImage.Set(x, y, color.RGBA{out, out, out, 255})
+				}
+			}
+
+			// Signal that the worker has finished
+			wg.Done()
+		}(i)
+	}
+
+	// Wait for all workers to finish
+	wg.Wait()
+
+	return outputImage, ctx.Err()
+}
+
+func sumOfAbsDiff(img image.Image, x int, y int, subimg image.Image) uint32 {
+	sum := uint32(0)
+	b := subimg.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+
+	for ny := 0; ny < h; ny++ {
+		for nx := 0; nx < w; nx++ {
+			t := img.At(x+nx, y+ny)
+			n := subimg.At(b.Min.X+nx, b.Min.Y+ny)
+			sum += rgbAbsSum(t, n)
+		}
+	}
+	return sum
+}
+
+func sumOfAbsDiffRGBA(img *image.RGBA, x int, y int, subimg *image.RGBA) uint32 {
+	sum := uint32(0)
+	b := subimg.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+
+	ipix := img.Pix
+	spix := subimg.Pix
+
+	for ny := 0; ny < h; ny++ {
+		for nx := 0; nx < w; nx++ {
+			i := img.PixOffset(x+nx, y+ny)
+			j := subimg.PixOffset(b.Min.X+nx, b.Min.Y+ny)
+			// sum += rgbAbsSumSliceBitwise(
+			// 	ipix[i:i+4:i+4],
+			// 	spix[j:j+4:j+4],
+			// )
+			sum += rgbAbsSumSliceBitwise(
+				ipix[i:i+3:i+3],
+				spix[j:j+3:j+3],
+			)
+		}
+	}
+	return sum
+}
+
+func convolutionTopK(img *image.RGBA, subimg *image.RGBA, k int) Matches {
+	// Iterate over the target image and find the closest matches
+	imgr := img.Bounds()
+	subimgr := subimg.Bounds()
+	subw := subimgr.Dx()
+	subh := subimgr.Dy()
+
+	inner := image.Rect(
+		imgr.Min.X,
+		imgr.Min.Y,
+		imgr.Max.X-subw,
+		imgr.Max.Y-subh,
+	)
+
+	var matches []Match
+	var minSums []uint32
+	// totalSum := 0.
+
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			// Loop over needle
+			// sum := uint32(0)
+			sum := sumOfAbsDiffRGBA(img, x, y, subimg)
+			// for ny := subimgr.Min.Y; ny < subimgr.Max.Y; ny++ {
+			// 	for nx := subimgr.Min.X; nx < subimgr.Max.X; nx++ {
+			// 		// Multiply corresponding pixels
+			// 		targetPixel := img.At(x+nx, y+ny)
+			// 		needlePixel := subimg.At(nx, ny)
+			// 		// Pixel diff
+			// 		sum += rgbAbsSum(targetPixel, needlePixel)
+			// 	}
+			// }
+
+			// totalSum += float64(sum)
+			bounds := image.Rect(x, y, x+subw, y+subh)
+
+			// Check if the current match is one of the top k matches
+			if len(matches) < k {
+				matches = append(matches, Match{Bounds: bounds, Match: float64(sum)})
+				minSums = append(minSums, sum)
+			} else {
+				maxDiffIndex := 0
+				for i := 1; i < k; i++ {
+					if minSums[i] > minSums[maxDiffIndex] {
+						maxDiffIndex = i
+					}
+				}
+				if sum < minSums[maxDiffIndex] {
+					matches[maxDiffIndex] = Match{Bounds: bounds, Match: float64(sum)}
+					minSums[maxDiffIndex] = sum
+				}
+			}
+		}
+	}
+
+	norm := 1 / float64(subw*subh*0xFF*3)
+	for i := 0; i < len(matches); i++ {
+		matches[i].Match = 1 - matches[i].Match*norm
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Match > matches[j].Match
+	})
+
+	return matches
+}
+
+func convolutionTopKParallel(ctx context.Context, img *image.RGBA, subimg *image.RGBA, metric Metric, sel selection) (Matches, error) {
+	// Iterate over the target image and find the closest matches
+	imgr := img.Bounds()
+	subimgr := subimg.Bounds()
+	subw := subimgr.Dx()
+	subh := subimgr.Dy()
+
+	inner := image.Rect(
+		imgr.Min.X,
+		imgr.Min.Y,
+		imgr.Max.X-subw,
+		imgr.Max.Y-subh,
+	)
+
+	if sel.k < 1 && sel.threshold == noThreshold {
+		sel.k = 1
+	}
+
+	if inner.Empty() {
+		return nil, nil
+	}
+
+	scorer := newScorer(metric, subimg)
+
+	// Each worker keeps only the positions of its slice that can be
+	// selected, by index in a row-major score map of inner
+	w := inner.Dx()
+	visits := sel.visits(subimgr.Size())
+	numWorkers := runtime.NumCPU() * 2
+	tops := make([][]scored, numWorkers)
+	sliceHeight := inner.Dy() / numWorkers
+	wg := sync.WaitGroup{}
+
+	// Launch workers
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			// Calculate the bounds for the current worker
+			ya := inner.Min.Y + workerID*sliceHeight
+			yb := ya + sliceHeight
+			// Make sure the last slice goes till the edge
+			if workerID == numWorkers-1 {
+				yb = inner.Max.Y
+			}
+
+			xa := inner.Min.X
+			xb := inner.Max.X
+
+			// Iterate over the target image slice, keeping what was found so
+			// far if cancelled
+			top := newTopScores(visits, sel.threshold)
+			for y := ya; y < yb; y++ {
+				if ctx.Err() != nil {
+					break
+				}
+				row := (y - inner.Min.Y) * w
+				for x := xa; x < xb; x++ {
+					// Perform the convolution operation
+					top.push(row+x-xa, scorer.score(img, x, y))
+				}
+			}
+			tops[workerID] = top.items
+
+			// Signal that the worker has finished
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	// Select the best matches over all the slices
+	return selectScored(tops, inner, subimgr.Size(), sel), ctx.Err()
+}
+
+func rgbAbsSum(a, b color.Color) uint32 {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	var dr, dg, db uint32
+	if ar > br {
+		dr = ar - br
+	} else {
+		dr = br - ar
+	}
+	if ag > bg {
+		dg = ag - bg
+	} else {
+		dg = bg - ag
+	}
+	if ab > bb {
+		db = ab - bb
+	} else {
+		db = bb - ab
+	}
+	return (dr + dg + db) / 0xFF
+}
+
+func rgbAbsSumSlice(a, b []uint8) uint32 {
+	ar, ag, ab := a[0], a[1], a[2]
+	br, bg, bb := b[0], b[1], b[2]
+	var dr, dg, db uint8
+	if ar > br {
+		dr = ar - br
+	} else {
+		dr = br - ar
+	}
+	if ag > bg {
+		dg = ag - bg
+	} else {
+		dg = bg - ag
+	}
+	if ab > bb {
+		db = ab - bb
+	} else {
+		db = bb - ab
+	}
+	return uint32(dr) + uint32(dg) + uint32(db)
+}
+
+func bitwiseAbsDiff(a, b uint8) uint32 {
+	v := int32(a) - int32(b)
+	m := v >> (32 - 1)
+	return uint32((v + m) ^ m)
+}
+
+func rgbAbsSumSliceBitwise(a, b []uint8) uint32 {
+	return bitwiseAbsDiff(a[0], b[0]) + bitwiseAbsDiff(a[1], b[1]) + bitwiseAbsDiff(a[2], b[2])
+}
+
+func multiplyPixels(pixel1 color.Color, pixel2 color.Color) color.Color {
+	r1, g1, b1, a1 := pixel1.RGBA()
+	r2, g2, b2, a2 := pixel2.RGBA()
+	r := uint8((r1 * r2) >> 8)
+	g := uint8((g1 * g2) >> 8)
+	b := uint8((b1 * b2) >> 8)
+	a := uint8((a1 * a2) >> 8)
+	return color.RGBA{r, g, b, a}
+}
+
+func calculateMeanColor(img image.Image) color.Color {
+	bounds := img.Bounds()
+	var r, g, b, a uint32
+	var count uint32
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.At(x, y)
+			pr, pg, pb, pa := pixel.RGBA()
+			r += pr
+			g += pg
+			b += pb
+			a += pa
+			count++
+		}
+	}
+
+	r /= count
+	g /= count
+	b /= count
+	a /= count
+
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	imgWidth := bounds.Max.X - bounds.Min.X
+	imgHeight := bounds.Max.Y - bounds.Min.Y
+
+	if width == 0 {
+		width = int(float64(height) * float64(imgWidth) / float64(imgHeight))
+	} else if height == 0 {
+		height = int(float64(width) * float64(imgHeight) / float64(imgWidth))
+	}
+
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return resized
+}
@@ -0,0 +1,693 @@
+package match
+
+import (
+	"context"
+	"image"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// The FFT backend computes the SSD and ZNCC metrics for every position as a
+// cross-correlation in O(N log N) instead of O(W·H·w·h):
+//
+//	SSD(x, y) = Σ I(x+i, y+j)² - 2 Σ I(x+i, y+j)·T(i, j) + Σ T(i, j)²
+//	ZNCC(x, y) ∝ Σ I(x+i, y+j)·(T(i, j) - mean(T))
+//
+// The window sums of I and I² come from summed-area tables, the correlation
+// from the FFT and the template terms are constant.
+//
+// SAD cannot be expressed as a correlation, so for SAD the best
+// fftCandidates*k positions by SSD that are at least fftCandidateDist pixels
+// apart are taken as candidates. Each candidate is moved to the best of its
+// neighbors by SAD until it reaches a local maximum, and only then are all the
+// positions scored with SAD selected, so that the suppression of overlapping
+// matches is decided by SAD like with the direct backend. The reported scores
+// are exact SAD scores and the best match is nearly always the same as with
+// the direct backend, but weaker matches can differ where SSD does not rank
+// the position the direct backend would pick among its candidates. SSD and
+// ZNCC scores match the direct backend up to floating point error (about
+// 1e-9).
+const (
+	fftCandidates    = 16
+	fftCandidateDist = 3
+)
+
+// convolutionTopKFFT returns the top k matches of subimg in the image of
+// fimg, like convolutionTopKParallel, but uses FFT-based cross-correlation
+// to find them.
+//
+// The score map is only usable once it is complete, so if ctx is cancelled
+// no matches are returned.
+func convolutionTopKFFT(ctx context.Context, fimg *fftImage, subimg *image.RGBA, metric Metric, sel selection) (Matches, error) {
+	img := fimg.img
+	imgr := img.Bounds()
+	subimgr := subimg.Bounds()
+	subw := subimgr.Dx()
+	subh := subimgr.Dy()
+
+	inner := image.Rect(
+		imgr.Min.X,
+		imgr.Min.Y,
+		imgr.Max.X-subw,
+		imgr.Max.Y-subh,
+	)
+
+	if sel.k < 1 && sel.threshold == noThreshold {
+		sel.k = 1
+	}
+
+	if inner.Empty() {
+		return nil, nil
+	}
+
+	rankMetric := metric
+	if metric != MetricSSD && metric != MetricZNCC {
+		rankMetric = MetricSSD
+	}
+
+	scores, err := scoreMapFFT(ctx, fimg, subimg, inner, rankMetric)
+	if err != nil {
+		return nil, err
+	}
+
+	if rankMetric == metric {
+		return selectScores(scores, inner, subimgr.Size(), sel), nil
+	}
+
+	// The SAD score is never higher than the SSD score at the same position,
+	// so ranking by SSD with the same threshold does not lose any matches.
+	candidates := selectScores(scores, inner, subimgr.Size(), selection{
+		k:         sel.k * fftCandidates,
+		threshold: sel.threshold,
+		nms:       nms{dist: fftCandidateDist},
+	})
+	scorer := newScorer(metric, subimg)
+	return sel.apply(climbMatches(img, inner, scorer, candidates)), nil
+}
+
+// climbMatches moves each match to the best of its 8 neighbors by scorer
+// until it is better than all of them, and returns all the positions scored
+// on the way in row-major order, which is the order ties are broken in by
+// the direct backend.
+func climbMatches(img *image.RGBA, inner image.Rectangle, scorer scorer, matches Matches) Matches {
+	if len(matches) == 0 {
+		return nil
+	}
+
+	scores := make(map[image.Point]float64)
+	score := func(p image.Point) float64 {
+		if !p.In(inner) {
+			return math.Inf(-1)
+		}
+		v, ok := scores[p]
+		if !ok {
+			v = scorer.score(img, p.X, p.Y)
+			scores[p] = v
+		}
+		return v
+	}
+
+	for _, m := range matches {
+		p := m.Bounds.Min
+		best := score(p)
+		for {
+			next := p
+			for y := p.Y - 1; y <= p.Y+1; y++ {
+				for x := p.X - 1; x <= p.X+1; x++ {
+					if v := score(image.Pt(x, y)); v > best {
+						best = v
+						next = image.Pt(x, y)
+					}
+				}
+			}
+			if next == p {
+				break
+			}
+			p = next
+		}
+	}
+
+	size := matches[0].Bounds.Size()
+	climbed := make(Matches, 0, len(scores))
+	for p, v := range scores {
+		climbed = append(climbed, Match{
+			Bounds: image.Rectangle{p, p.Add(size)},
+			Match:  v,
+		})
+	}
+	sort.Slice(climbed, func(i, j int) bool {
+		a, b := climbed[i].Bounds.Min, climbed[j].Bounds.Min
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+	return climbed
+}
+
+// scoreMapFFT returns the SSD or ZNCC score of subimg for every position in
+// inner, in row-major order.
+func scoreMapFFT(ctx context.Context, fimg *fftImage, subimg *image.RGBA, inner image.Rectangle, metric Metric) ([]float64, error) {
+	if !subimg.Opaque() {
+		return maskedScoreMapFFT(ctx, fimg, subimg, inner, metric)
+	}
+
+	zeroMean := metric == MetricZNCC
+	corr, err := crossCorrelationFFT(ctx, fimg, subimg, zeroMean)
+	if err != nil {
+		return nil, err
+	}
+	st := newSumTables(fimg.img)
+
+	subimgr := subimg.Bounds()
+	subw := subimgr.Dx()
+	subh := subimgr.Dy()
+	n := float64(subw * subh)
+
+	// Sums and squared sums of the subimage
+	var t1 [3]float64
+	t2 := 0.
+	for y := subimgr.Min.Y; y < subimgr.Max.Y; y++ {
+		for x := subimgr.Min.X; x < subimgr.Max.X; x++ {
+			i := subimg.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				v := float64(subimg.Pix[i+c])
+				t1[c] += v
+				t2 += v * v
+			}
+		}
+	}
+	tdev := t2
+	for c := 0; c < 3; c++ {
+		tdev -= t1[c] * t1[c] / n
+	}
+
+	ssdNorm := 1 / (n * 3 * 0xFF * 0xFF)
+
+	imgr := fimg.img.Bounds()
+	w := inner.Dx()
+	scores := make([]float64, w*inner.Dy())
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			ix := x - imgr.Min.X
+			iy := y - imgr.Min.Y
+			i2 := st.sq.sum(ix, iy, subw, subh)
+			c := corr.at(ix, iy)
+			var v float64
+			if zeroMean {
+				dev := i2
+				for ch := 0; ch < 3; ch++ {
+					s := st.ch[ch].sum(ix, iy, subw, subh)
+					dev -= s * s / n
+				}
+				v = zncc(c, dev, tdev)
+			} else {
+				ssd := i2 - 2*c + t2
+				if ssd < 0 {
+					// Rounding error
+					ssd = 0
+				}
+				v = 1 - ssd*ssdNorm
+			}
+			scores[(y-inner.Min.Y)*w+(x-inner.Min.X)] = v
+		}
+	}
+	return scores, nil
+}
+
+// maskedScoreMapFFT is scoreMapFFT for subimages with transparency, where
+// the window sums are weighted by the alpha of the subimage and thus also
+// have to be computed as correlations with the weights W:
+//
+//	SSD(x, y) = Σ W·I² - 2 Σ I·(W·T) + Σ W·T²
+//	ZNCC(x, y) ∝ Σ I·W·(T - mean(T))
+//	dev(x, y) = Σ W·I² - (Σ W·I)² / Σ W
+func maskedScoreMapFFT(ctx context.Context, fimg *fftImage, subimg *image.RGBA, inner image.Rectangle, metric Metric) ([]float64, error) {
+	zeroMean := metric == MetricZNCC
+	m := newMaskedSubimage(subimg)
+	mean := m.mean()
+
+	imgr := fimg.img.Bounds()
+
+	// Constant terms of the subimage
+	t2 := 0.
+	tdev := 0.
+	for _, p := range m.pixels {
+		for c := 0; c < 3; c++ {
+			t2 += p.weight * p.c[c] * p.c[c]
+			d := p.c[c] - mean[c]
+			tdev += p.weight * d * d
+		}
+	}
+
+	// Loads the value of every opaque pixel, the others are zero
+	subw := subimg.Bounds().Dx()
+	subh := subimg.Bounds().Dy()
+	values := make([]float64, subw*subh)
+	loadPixels := func(s *spectrum, value func(p maskedPixel) float64) {
+		for _, p := range m.pixels {
+			values[p.y*subw+p.x] = value(p)
+		}
+		s.load(subw, subh, func(x, y int) float64 {
+			return values[y*subw+x]
+		})
+	}
+
+	weights := newSpectrum(fimg.w, fimg.h)
+	loadPixels(weights, func(p maskedPixel) float64 {
+		return p.weight
+	})
+
+	w := inner.Dx()
+	n := w * inner.Dy()
+	// -Σ (Σ W·I)² / Σ W over all channels
+	meanTerm := make([]float64, n)
+
+	acc := newSpectrum(fimg.w, fimg.h)
+	ft := newSpectrum(fimg.w, fimg.h)
+
+	for c := 0; c < 3; c++ {
+		loadPixels(ft, func(p maskedPixel) float64 {
+			v := p.c[c]
+			if zeroMean {
+				v -= mean[c]
+			}
+			return p.weight * v
+		})
+		acc.addProduct(fimg.channel(c), ft)
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if zeroMean {
+			// Σ W·I for this channel
+			ft.setProduct(fimg.channel(c), weights)
+			ft.inverse()
+			for y := inner.Min.Y; y < inner.Max.Y; y++ {
+				for x := inner.Min.X; x < inner.Max.X; x++ {
+					s := ft.at(x-imgr.Min.X, y-imgr.Min.Y)
+					meanTerm[(y-inner.Min.Y)*w+(x-inner.Min.X)] -= s * s / m.weight
+				}
+			}
+		}
+	}
+	acc.inverse()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Σ W·I² over all channels
+	ft.setProduct(fimg.squares(), weights)
+	ft.inverse()
+
+	ssdNorm := 1 / (m.weight * 3 * 0xFF * 0xFF)
+
+	scores := make([]float64, n)
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			ix := x - imgr.Min.X
+			iy := y - imgr.Min.Y
+			i := (y-inner.Min.Y)*w + (x - inner.Min.X)
+			i2 := ft.at(ix, iy)
+			c := acc.at(ix, iy)
+			var v float64
+			if m.weight == 0 {
+				v = 0
+			} else if zeroMean {
+				v = zncc(c, i2+meanTerm[i], tdev)
+			} else {
+				ssd := i2 - 2*c + t2
+				if ssd < 0 {
+					// Rounding error
+					ssd = 0
+				}
+				v = 1 - ssd*ssdNorm
+			}
+			scores[i] = v
+		}
+	}
+	return scores, nil
+}
+
+// crossCorrelationFFT returns the cross-correlation of the image of fimg and
+// subimg summed over the RGB channels. The value at (x, y) is
+// Σ I(x+i, y+j)·T(i, j), with coordinates relative to the image origin. If
+// zeroMean is set, the mean of each channel is subtracted from the subimage
+// first.
+func crossCorrelationFFT(ctx context.Context, fimg *fftImage, subimg *image.RGBA, zeroMean bool) (*spectrum, error) {
+	r := subimg.Bounds()
+	acc := newSpectrum(fimg.w, fimg.h)
+	ft := newSpectrum(fimg.w, fimg.h)
+
+	for c := 0; c < 3; c++ {
+		mean := 0.
+		if zeroMean {
+			mean = channelMean(subimg, c)
+		}
+		ft.load(r.Dx(), r.Dy(), func(x, y int) float64 {
+			return float64(subimg.Pix[subimg.PixOffset(r.Min.X+x, r.Min.Y+y)+c]) - mean
+		})
+		acc.addProduct(fimg.channel(c), ft)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	acc.inverse()
+	return acc, ctx.Err()
+}
+
+// channelMean returns the mean of channel c of img.
+func channelMean(img *image.RGBA, c int) float64 {
+	r := img.Bounds()
+	sum := 0.
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sum += float64(img.Pix[img.PixOffset(x, y)+c])
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// fftImage is an image prepared for the FFT backend: the spectra of its
+// channels, which are computed when first needed and then shared by all the
+// subimages searched in it.
+type fftImage struct {
+	img *image.RGBA
+	// Size of the zero-padded grids
+	w, h int
+	ch   [3]*spectrum
+	// Squared RGB values summed over the channels, only needed for
+	// subimages with transparency
+	sq *spectrum
+}
+
+func newFFTImage(img *image.RGBA) *fftImage {
+	r := img.Bounds()
+	return &fftImage{
+		img: img,
+		w:   nextPow2(r.Dx()),
+		h:   nextPow2(r.Dy()),
+	}
+}
+
+// channel returns the spectrum of channel c of the image.
+func (f *fftImage) channel(c int) *spectrum {
+	if f.ch[c] == nil {
+		f.ch[c] = f.load(func(i int) float64 {
+			return float64(f.img.Pix[i+c])
+		})
+	}
+	return f.ch[c]
+}
+
+// squares returns the spectrum of the squared RGB values of the image summed
+// over the channels.
+func (f *fftImage) squares() *spectrum {
+	if f.sq == nil {
+		f.sq = f.load(func(i int) float64 {
+			v := 0.
+			for c := 0; c < 3; c++ {
+				p := float64(f.img.Pix[i+c])
+				v += p * p
+			}
+			return v
+		})
+	}
+	return f.sq
+}
+
+// load returns the spectrum of the values returned by fn for the offset of
+// every pixel of the image.
+func (f *fftImage) load(fn func(i int) float64) *spectrum {
+	r := f.img.Bounds()
+	s := newSpectrum(f.w, f.h)
+	s.load(r.Dx(), r.Dy(), func(x, y int) float64 {
+		return fn(f.img.PixOffset(r.Min.X+x, r.Min.Y+y))
+	})
+	return s
+}
+
+// spectrum is the 2D FFT of a power-of-two sized w×h grid of real values.
+// As it is conjugate symmetric, only the w/2+1 columns of the non-negative
+// frequencies are kept, and the rows are transformed in pairs packed into
+// the real and imaginary parts of a single complex FFT, which halves both
+// the memory and the work of a complex grid.
+type spectrum struct {
+	w, h int
+	// Number of columns kept
+	stride int
+	data   []complex128
+}
+
+func newSpectrum(w, h int) *spectrum {
+	stride := w/2 + 1
+	// Rows are paired, so a single row needs room for the second one
+	rows := h + h%2
+	return &spectrum{
+		w:      w,
+		h:      h,
+		stride: stride,
+		data:   make([]complex128, rows*stride),
+	}
+}
+
+// load replaces the spectrum with the one of the w×h values returned by fn,
+// zero-padded to the size of the grid. fn is called concurrently.
+func (s *spectrum) load(w, h int, fn func(x, y int) float64) {
+	parallelRange((s.h+1)/2, func(a, b int) {
+		z := make([]complex128, s.w)
+		for pair := a; pair < b; pair++ {
+			y := 2 * pair
+			ra := s.data[y*s.stride : (y+1)*s.stride]
+			rb := s.data[(y+1)*s.stride : (y+2)*s.stride]
+			if y >= h {
+				for k := range ra {
+					ra[k] = 0
+					rb[k] = 0
+				}
+				continue
+			}
+
+			for x := range z {
+				z[x] = 0
+			}
+			for x := 0; x < w; x++ {
+				z[x] = complex(fn(x, y), 0)
+				if y+1 < h {
+					z[x] += complex(0, fn(x, y+1))
+				}
+			}
+			fft1d(z, false)
+
+			// Separate the spectra of the two rows
+			for k := range ra {
+				zk := z[k]
+				zn := cmplx.Conj(z[(s.w-k)%s.w])
+				ra[k] = (zk + zn) / 2
+				rb[k] = (zk - zn) / 2i
+			}
+		}
+	})
+	s.columns(false)
+}
+
+// inverse transforms the spectrum back to real values in place, which are
+// then read with at.
+func (s *spectrum) inverse() {
+	s.columns(true)
+	scale := complex(1/float64(s.w*s.h), 0)
+	parallelRange((s.h+1)/2, func(a, b int) {
+		z := make([]complex128, s.w)
+		for pair := a; pair < b; pair++ {
+			y := 2 * pair
+			ra := s.data[y*s.stride : (y+1)*s.stride]
+			rb := s.data[(y+1)*s.stride : (y+2)*s.stride]
+
+			// Restore the negative frequencies of both rows from the
+			// symmetry and pack them as in load
+			for k := range ra {
+				z[k] = ra[k] + 1i*rb[k]
+			}
+			for k := s.stride; k < s.w; k++ {
+				z[k] = cmplx.Conj(ra[s.w-k]) + 1i*cmplx.Conj(rb[s.w-k])
+			}
+			fft1d(z, true)
+
+			// The two rows of real values are the real and imaginary parts,
+			// which fit in the place of their spectra
+			out := s.data[y*s.stride : y*s.stride+s.w]
+			for x := range out {
+				out[x] = z[x] * scale
+			}
+		}
+	})
+}
+
+// at returns the real value at (x, y) after inverse.
+func (s *spectrum) at(x, y int) float64 {
+	v := s.data[(y&^1)*s.stride+x]
+	if y&1 == 0 {
+		return real(v)
+	}
+	return imag(v)
+}
+
+// columns transforms the columns of the spectrum in place.
+func (s *spectrum) columns(inverse bool) {
+	parallelRange(s.stride, func(a, b int) {
+		col := make([]complex128, s.h)
+		for x := a; x < b; x++ {
+			for y := range col {
+				col[y] = s.data[y*s.stride+x]
+			}
+			fft1d(col, inverse)
+			for y := range col {
+				s.data[y*s.stride+x] = col[y]
+			}
+		}
+	})
+}
+
+// addProduct adds a·conj(b) to the spectrum, which is the spectrum of the
+// cross-correlation of the values of a and b.
+func (s *spectrum) addProduct(a, b *spectrum) {
+	for i := range s.data {
+		s.data[i] += a.data[i] * cmplx.Conj(b.data[i])
+	}
+}
+
+// setProduct replaces the spectrum with a·conj(b).
+func (s *spectrum) setProduct(a, b *spectrum) {
+	for i := range s.data {
+		s.data[i] = a.data[i] * cmplx.Conj(b.data[i])
+	}
+}
+
+// fft1d performs an unnormalized in-place radix-2 FFT. The length of a must
+// be a power of two.
+func fft1d(a []complex128, inverse bool) {
+	n := len(a)
+	if n <= 1 {
+		return
+	}
+
+	// Bit reversal permutation
+	shift := 64 - uint(bits.TrailingZeros(uint(n)))
+	for i := 0; i < n; i++ {
+		j := int(bits.Reverse64(uint64(i)) >> shift)
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	sign := -1.
+	if inverse {
+		sign = 1.
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size >> 1
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for i := 0; i < half; i++ {
+				u := a[start+i]
+				v := a[start+i+half] * w
+				a[start+i] = u + v
+				a[start+i+half] = u - v
+				w *= step
+			}
+		}
+	}
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// parallelRange splits [0, n) into chunks and calls fn for each of them
+// concurrently.
+func parallelRange(n int, fn func(a, b int)) {
+	numWorkers := runtime.NumCPU()
+	if numWorkers > n {
+		numWorkers = n
+	}
+	chunk := (n + numWorkers - 1) / numWorkers
+	wg := sync.WaitGroup{}
+	for a := 0; a < n; a += chunk {
+		b := a + chunk
+		if b > n {
+			b = n
+		}
+		wg.Add(1)
+		go func(a, b int) {
+			fn(a, b)
+			wg.Done()
+		}(a, b)
+	}
+	wg.Wait()
+}
+
+// sumTable is a summed-area table with an extra zero row and column.
+type sumTable struct {
+	w    int
+	data []float64
+}
+
+func newSumTable(w, h int) sumTable {
+	return sumTable{
+		w:    w + 1,
+		data: make([]float64, (w+1)*(h+1)),
+	}
+}
+
+// sumTables holds summed-area tables of the squared RGB values and of each
+// RGB channel of an image.
+type sumTables struct {
+	sq sumTable
+	ch [3]sumTable
+}
+
+func newSumTables(img *image.RGBA) sumTables {
+	r := img.Bounds()
+	st := sumTables{sq: newSumTable(r.Dx(), r.Dy())}
+	for c := 0; c < 3; c++ {
+		st.ch[c] = newSumTable(r.Dx(), r.Dy())
+	}
+	w := st.sq.w
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		var row [3]float64
+		rowsq := 0.
+		ty := y - r.Min.Y + 1
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			tx := x - r.Min.X + 1
+			for c := 0; c < 3; c++ {
+				v := float64(img.Pix[i+c])
+				row[c] += v
+				rowsq += v * v
+				st.ch[c].data[ty*w+tx] = st.ch[c].data[(ty-1)*w+tx] + row[c]
+			}
+			st.sq.data[ty*w+tx] = st.sq.data[(ty-1)*w+tx] + rowsq
+		}
+	}
+	return st
+}
+
+// sum returns the sum of the w×h rectangle with the top-left corner at
+// (x, y).
+func (t sumTable) sum(x, y, w, h int) float64 {
+	a := t.data[y*t.w+x]
+	b := t.data[y*t.w+x+w]
+	c := t.data[(y+h)*t.w+x]
+	d := t.data[(y+h)*t.w+x+w]
+	return d - b - c + a
+}
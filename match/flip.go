@@ -0,0 +1,51 @@
+package match
+
+import "image"
+
+// Flip is a mirroring of the subimage.
+type Flip string
+
+const (
+	// FlipNone is the subimage as is.
+	FlipNone Flip = "none"
+	// FlipH is the subimage mirrored horizontally, left to right.
+	FlipH Flip = "h"
+	// FlipV is the subimage mirrored vertically, top to bottom.
+	FlipV Flip = "v"
+	// FlipBoth is the subimage mirrored both horizontally and vertically.
+	FlipBoth Flip = "both"
+)
+
+// flips returns the orientations searched for Options.Flip, which includes
+// all the ones flipped in at most the same directions as f.
+func (f Flip) flips() []Flip {
+	switch f {
+	case FlipH:
+		return []Flip{FlipNone, FlipH}
+	case FlipV:
+		return []Flip{FlipNone, FlipV}
+	case FlipBoth:
+		return []Flip{FlipNone, FlipH, FlipV, FlipBoth}
+	default:
+		return []Flip{FlipNone}
+	}
+}
+
+// flipImage returns img flipped by f, with the origin at (0, 0).
+func flipImage(img image.Image, f Flip) *image.RGBA {
+	b := img.Bounds()
+	flipped := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := x, y
+			if f == FlipH || f == FlipBoth {
+				dx = b.Dx() - 1 - x
+			}
+			if f == FlipV || f == FlipBoth {
+				dy = b.Dy() - 1 - y
+			}
+			flipped.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return flipped
+}
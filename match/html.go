@@ -0,0 +1,115 @@
+package match
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"sync"
+)
+
+// run is the debug output of searching one haystack scale.
+type run struct {
+	Size    image.Point
+	Metric  Metric
+	Subruns []subrun
+}
+
+// subrun is the debug output of searching one subimage scale.
+type subrun struct {
+	Image       image.Image
+	Selected    bool
+	Skipped     bool
+	Reason      string
+	Subimage    image.Image
+	Convolution image.Image
+	Visualized  image.Image
+	Matches     []Match
+}
+
+func (r run) PrintHTML(w io.Writer, t *template.Template) error {
+	err := t.Execute(w, r)
+	if err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	return nil
+}
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+var templates struct {
+	header *template.Template
+	footer *template.Template
+	needle *template.Template
+	result *template.Template
+	run    *template.Template
+}
+var templatesOnce sync.Once
+var templatesErr error
+
+func loadTemplates() error {
+	templatesOnce.Do(func() {
+		funcs := template.FuncMap{
+			"imgsrc": func(img image.Image) (template.URL, error) {
+				if img == nil {
+					return template.URL(""), nil
+				}
+				b64, err := pngb64(img)
+				if err != nil {
+					return "", err
+				}
+				return template.URL(fmt.Sprintf("data:image/png;base64,%s", b64)), nil
+			},
+			"dim": func(img image.Image) string {
+				if img == nil {
+					return "0x0"
+				}
+				bounds := img.Bounds()
+				return fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy())
+			},
+			"probalpha": func(prob float64) float64 {
+				return math.Max(0, 1-(1-prob)*10)
+			},
+		}
+
+		parse := func(name string) *template.Template {
+			if templatesErr != nil {
+				return nil
+			}
+			t, err := template.
+				New(name).
+				Funcs(funcs).
+				ParseFS(templatesFS, "templates/"+name)
+			if err != nil {
+				templatesErr = fmt.Errorf("failed to parse template: %w", err)
+			}
+			return t
+		}
+
+		templates.run = parse("run.html")
+		templates.header = parse("header.html")
+		templates.footer = parse("footer.html")
+		templates.needle = parse("needle.html")
+		templates.result = parse("result.html")
+	})
+	return templatesErr
+}
+
+func pngb64(img image.Image) (string, error) {
+	// Encode the image
+	buffer := new(bytes.Buffer)
+	err := png.Encode(buffer, img)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	// Convert the bytes buffer to a base64 string
+	encoded := base64.StdEncoding.EncodeToString(buffer.Bytes())
+
+	return encoded, nil
+}
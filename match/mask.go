@@ -0,0 +1,175 @@
+package match
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// maskedPixel is a subimage pixel with a non-zero weight.
+type maskedPixel struct {
+	x, y   int
+	weight float64
+	// Color with the alpha premultiplication undone
+	c [3]float64
+}
+
+// maskedSubimage holds the pixels of a subimage with transparency, where the
+// alpha of every pixel is used as its weight in the match metric, so that
+// fully transparent pixels are ignored and partially transparent ones count
+// less.
+type maskedSubimage struct {
+	pixels []maskedPixel
+	// Sum of all the weights
+	weight float64
+}
+
+func newMaskedSubimage(subimg *image.RGBA) maskedSubimage {
+	m := maskedSubimage{}
+	b := subimg.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := subimg.PixOffset(x, y)
+			a := subimg.Pix[i+3]
+			if a == 0 {
+				continue
+			}
+			p := maskedPixel{
+				x:      x - b.Min.X,
+				y:      y - b.Min.Y,
+				weight: float64(a) / 0xFF,
+			}
+			for c := 0; c < 3; c++ {
+				p.c[c] = float64(subimg.Pix[i+c]) / p.weight
+			}
+			m.pixels = append(m.pixels, p)
+			m.weight += p.weight
+		}
+	}
+	return m
+}
+
+// mean returns the weighted mean of each channel.
+func (m maskedSubimage) mean() [3]float64 {
+	var mean [3]float64
+	if m.weight == 0 {
+		return mean
+	}
+	for _, p := range m.pixels {
+		for c := 0; c < 3; c++ {
+			mean[c] += p.weight * p.c[c]
+		}
+	}
+	for c := 0; c < 3; c++ {
+		mean[c] /= m.weight
+	}
+	return mean
+}
+
+func newMaskedScorer(metric Metric, subimg *image.RGBA) scorer {
+	m := newMaskedSubimage(subimg)
+	switch metric {
+	case MetricSSD:
+		return maskedSSDScorer{m}
+	case MetricZNCC:
+		return newMaskedZNCCScorer(m)
+	default:
+		return maskedSADScorer{m}
+	}
+}
+
+type maskedSADScorer struct {
+	maskedSubimage
+}
+
+func (s maskedSADScorer) score(img *image.RGBA, x int, y int) float64 {
+	if s.weight == 0 {
+		return 0
+	}
+	sum := 0.
+	for _, p := range s.pixels {
+		i := img.PixOffset(x+p.x, y+p.y)
+		for c := 0; c < 3; c++ {
+			sum += p.weight * math.Abs(float64(img.Pix[i+c])-p.c[c])
+		}
+	}
+	return 1 - sum/(s.weight*0xFF*3)
+}
+
+type maskedSSDScorer struct {
+	maskedSubimage
+}
+
+func (s maskedSSDScorer) score(img *image.RGBA, x int, y int) float64 {
+	if s.weight == 0 {
+		return 0
+	}
+	sum := 0.
+	for _, p := range s.pixels {
+		i := img.PixOffset(x+p.x, y+p.y)
+		for c := 0; c < 3; c++ {
+			d := float64(img.Pix[i+c]) - p.c[c]
+			sum += p.weight * d * d
+		}
+	}
+	return 1 - sum/(s.weight*0xFF*0xFF*3)
+}
+
+type maskedZNCCScorer struct {
+	maskedSubimage
+	mean [3]float64
+	// Weighted sum of squared deviations from the mean over all channels
+	dev float64
+}
+
+func newMaskedZNCCScorer(m maskedSubimage) maskedZNCCScorer {
+	s := maskedZNCCScorer{maskedSubimage: m, mean: m.mean()}
+	for _, p := range m.pixels {
+		for c := 0; c < 3; c++ {
+			d := p.c[c] - s.mean[c]
+			s.dev += p.weight * d * d
+		}
+	}
+	return s
+}
+
+func (s maskedZNCCScorer) score(img *image.RGBA, x int, y int) float64 {
+	if s.weight == 0 {
+		return 0
+	}
+	var isum, isum2 [3]float64
+	num := 0.
+	for _, p := range s.pixels {
+		i := img.PixOffset(x+p.x, y+p.y)
+		for c := 0; c < 3; c++ {
+			v := float64(img.Pix[i+c])
+			isum[c] += p.weight * v
+			isum2[c] += p.weight * v * v
+			num += p.weight * v * (p.c[c] - s.mean[c])
+		}
+	}
+	dev := 0.
+	for c := 0; c < 3; c++ {
+		dev += isum2[c] - isum[c]*isum[c]/s.weight
+	}
+	return zncc(num, dev, s.dev)
+}
+
+// ApplyMask returns subimg with its alpha multiplied by the luminance and
+// alpha of mask, resized to the size of subimg. White mask pixels are kept,
+// black ones are ignored when matching.
+func ApplyMask(subimg image.Image, mask image.Image) *image.RGBA {
+	b := subimg.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+
+	gray := image.NewGray(r)
+	draw.CatmullRom.Scale(gray, r, mask, mask.Bounds(), draw.Src, nil)
+
+	// Use the luminance as alpha
+	alpha := &image.Alpha{Pix: gray.Pix, Stride: gray.Stride, Rect: gray.Rect}
+
+	masked := image.NewRGBA(r)
+	draw.DrawMask(masked, r, subimg, b.Min, alpha, image.Point{}, draw.Src)
+	return masked
+}
@@ -0,0 +1,1007 @@
+// Package match finds a subimage (needle) within a larger image (haystack).
+//
+// The haystack is searched at multiple scales, starting small and doubling
+// in width until the best match stops improving, so the subimage does not
+// have to appear at its original size.
+package match
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+)
+
+// Backend selects how the match scores are computed.
+type Backend string
+
+const (
+	// BackendDirect computes every score directly, which is fastest for
+	// small images.
+	BackendDirect Backend = "direct"
+	// BackendFFT uses FFT-based cross-correlation, which is faster for large
+	// images, e.g. when matching at full resolution.
+	BackendFFT Backend = "fft"
+)
+
+// Metric selects how the similarity of the subimage and the haystack is
+// measured. All of them are turned into a score where higher is better and 1
+// is a perfect match.
+type Metric string
+
+const (
+	// MetricSAD is the sum of absolute differences, 1 - SAD / (n * 255 * 3)
+	MetricSAD Metric = "sad"
+	// MetricSSD is the sum of squared differences, 1 - SSD / (n * 255² * 3)
+	MetricSSD Metric = "ssd"
+	// MetricZNCC is the zero-mean normalized cross-correlation in [-1, 1],
+	// insensitive to brightness and contrast changes between the images.
+	MetricZNCC Metric = "zncc"
+)
+
+// Options configures Find. Zero values are replaced by the ones in
+// DefaultOptions.
+type Options struct {
+	// Minimum and maximum width of the resized haystack
+	ImageMinWidth int
+	ImageMaxWidth int
+	// Minimum area of the resized subimage
+	SubimageMinArea int
+	// Maximum division of the subimage size at every haystack scale
+	SubimageMaxDiv int
+	// If ScaleMin or ScaleMax is set, the subimage is searched at every scale
+	// from ScaleMin to ScaleMax relative to its original size, each at most
+	// ScaleStep times the previous one, instead of at power of two divisions
+	// of its size (1, 1/2, 1/4, ...). An unset bound defaults to 1.
+	ScaleMin  float64
+	ScaleMax  float64
+	ScaleStep float64
+	// If set, the subimage is also searched rotated clockwise by every
+	// multiple of AngleStep degrees, e.g. 90 for right angles only
+	AngleStep float64
+	// If set, the subimage is also searched mirrored horizontally (FlipH),
+	// vertically (FlipV) or in any direction (FlipBoth)
+	Flip Flip
+	// Number of top matches to return. If Threshold is set and K is not, all
+	// the matches above the threshold are returned.
+	K int
+	// Minimum score of the returned matches
+	Threshold float64
+	// Suppress matches overlapping a better match by more than this
+	// intersection over union (0-1)
+	NMSIoU float64
+	// Suppress matches closer than this many pixels to a better match
+	NMSDistance float64
+	Backend     Backend
+	Metric      Metric
+	// If set, only the part of the haystack within it is searched. The
+	// matches are still in haystack coordinates.
+	ROI image.Rectangle
+	// If set and the needle does not fit into the haystack, but the haystack
+	// fits into the needle, the haystack is searched for in the needle
+	// instead. The matches are then in the coordinates of the needle, and
+	// ROI applies to the needle.
+	Swap bool
+	// Refine matches to pixel-exact bounds at full resolution
+	Refine bool
+	// Log the progress of the search
+	Verbose bool
+	// If set, an HTML page visualizing the search is written to it
+	HTML io.Writer
+}
+
+// DefaultOptions are used for any unset Options.
+var DefaultOptions = Options{
+	K:               6,
+	ImageMinWidth:   8,
+	ImageMaxWidth:   256,
+	SubimageMaxDiv:  64,
+	SubimageMinArea: 5 * 5,
+	ScaleStep:       1.1,
+	Backend:         BackendDirect,
+	Metric:          MetricSAD,
+}
+
+// selection returns the match selection for an image scaled by scale.
+func (opts Options) selection(scale float64) selection {
+	sel := selection{
+		k:         opts.K,
+		threshold: noThreshold,
+		nms: nms{
+			iou:  opts.NMSIoU,
+			dist: opts.NMSDistance * scale,
+		},
+	}
+	if opts.Threshold != 0 {
+		sel.threshold = opts.Threshold
+	}
+	if opts.Threshold > 0 && !sel.nms.enabled() {
+		// Find all mode returns non-overlapping matches by default
+		sel.nms.disjoint = true
+	}
+	return sel
+}
+
+// candidates returns the selection of matches found before refining them,
+// with more of them than opts.selection if some converge when refined, see
+// refineMatches.
+func (opts Options) candidates(scale float64) selection {
+	if !opts.Refine {
+		return opts.selection(scale)
+	}
+	sel := opts.refineSelection(scale)
+	sel.k *= refineCandidates
+	return sel
+}
+
+// Match is an occurrence of the subimage in the haystack.
+type Match struct {
+	// Bounds of the subimage in the haystack
+	Bounds image.Rectangle `json:"bounds"`
+	// Score of the match, higher is better, see Metric
+	Match float64 `json:"match"`
+	// Size of the subimage in the haystack relative to its original size
+	SubimageScale float64 `json:"scale"`
+	// Clockwise rotation of the subimage in the haystack in degrees
+	Angle float64 `json:"angle"`
+	// Bounds in the pixels of the haystack before it was transformed by
+	// Orientation.Apply, only set by callers, see Matches.Orient
+	RawBounds image.Rectangle `json:"-"`
+	// Index of the haystack frame, see FindFrames
+	Frame int `json:"frame,omitempty"`
+	// Set if the haystack was found in the subimage instead, see Options.Swap
+	Swapped bool `json:"swapped,omitempty"`
+	// Mirroring of the subimage in the haystack, only set when searching with
+	// Options.Flip
+	Flip Flip `json:"flip,omitempty"`
+	// Corners of the rotated subimage, clockwise from its top-left corner.
+	// Only set when searching with Options.AngleStep, in which case Bounds is
+	// the bounding box of the polygon.
+	Polygon []Point `json:"polygon,omitempty"`
+	// Sub-pixel position of the top-left corner of Bounds
+	X float64 `json:"-"`
+	Y float64 `json:"-"`
+	// Set if X and Y were fitted to the scores at the original resolution of
+	// the haystack, otherwise they are only estimated from a downscaled one
+	// (see Options.Refine) or the fit was rejected, e.g. at the edge of the
+	// haystack
+	Subpixel bool `json:"-"`
+}
+
+// Point is a position with sub-pixel precision.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (m Match) MarshalJSON() ([]byte, error) {
+	type Bounds struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+		W int `json:"w"`
+		H int `json:"h"`
+	}
+	var subpixel *Point
+	if m.Subpixel {
+		subpixel = &Point{X: m.X, Y: m.Y}
+	}
+	var raw *Bounds
+	if !m.RawBounds.Empty() {
+		raw = &Bounds{
+			X: m.RawBounds.Min.X,
+			Y: m.RawBounds.Min.Y,
+			W: m.RawBounds.Dx(),
+			H: m.RawBounds.Dy(),
+		}
+	}
+	return json.Marshal(struct {
+		Bounds   Bounds  `json:"bounds"`
+		Raw      *Bounds `json:"raw,omitempty"`
+		Subpixel *Point  `json:"subpixel,omitempty"`
+		Scale    float64 `json:"scale"`
+		Angle    float64 `json:"angle,omitempty"`
+		Flip     Flip    `json:"flip,omitempty"`
+		Polygon  []Point `json:"polygon,omitempty"`
+		Swapped  bool    `json:"swapped,omitempty"`
+		Frame    int     `json:"frame,omitempty"`
+		Match    float64 `json:"match"`
+	}{
+		Bounds: Bounds{
+			X: m.Bounds.Min.X,
+			Y: m.Bounds.Min.Y,
+			W: m.Bounds.Dx(),
+			H: m.Bounds.Dy(),
+		},
+		Raw:      raw,
+		Subpixel: subpixel,
+		Scale:    m.SubimageScale,
+		Angle:    m.Angle,
+		Flip:     m.Flip,
+		Polygon:  m.Polygon,
+		Swapped:  m.Swapped,
+		Frame:    m.Frame,
+		Match:    m.Match,
+	})
+}
+
+// Scale returns the match with the bounds and position multiplied by scale.
+// The position is no longer fitted at the original resolution unless scale is
+// 1, see Match.Subpixel.
+func (m Match) Scale(scale float64) Match {
+	m.X *= scale
+	m.Y *= scale
+	if scale != 1 {
+		m.Subpixel = false
+	}
+	if m.Polygon != nil {
+		polygon := make([]Point, len(m.Polygon))
+		for i, p := range m.Polygon {
+			polygon[i] = Point{X: p.X * scale, Y: p.Y * scale}
+		}
+		m.Polygon = polygon
+	}
+	m.Bounds = image.Rectangle{
+		Min: image.Point{
+			X: int(float64(m.Bounds.Min.X) * scale),
+			Y: int(float64(m.Bounds.Min.Y) * scale),
+		},
+		Max: image.Point{
+			X: int(float64(m.Bounds.Max.X) * scale),
+			Y: int(float64(m.Bounds.Max.Y) * scale),
+		},
+	}
+	return m
+}
+
+// Add returns the match translated by p.
+func (m Match) Add(p image.Point) Match {
+	m.Bounds = m.Bounds.Add(p)
+	m.X += float64(p.X)
+	m.Y += float64(p.Y)
+	if m.Polygon != nil {
+		polygon := make([]Point, len(m.Polygon))
+		for i, c := range m.Polygon {
+			polygon[i] = Point{X: c.X + float64(p.X), Y: c.Y + float64(p.Y)}
+		}
+		m.Polygon = polygon
+	}
+	return m
+}
+
+// Matches is a list of matches, usually sorted by score.
+type Matches []Match
+
+// Scale scales all the matches in place, see Match.Scale.
+func (m Matches) Scale(scale float64) Matches {
+	for i := range m {
+		m[i] = m[i].Scale(scale)
+	}
+	return m
+}
+
+// Orient sets the RawBounds of all the matches in place, for matches in a
+// haystack of size transformed by o, see Orientation.Raw. Swapped matches
+// are in the needle and left as is.
+func (m Matches) Orient(o Orientation, size image.Point) Matches {
+	for i := range m {
+		if m[i].Swapped {
+			continue
+		}
+		m[i].RawBounds = o.Raw(m[i].Bounds, size)
+	}
+	return m
+}
+
+// Add translates all the matches in place, see Match.Add.
+func (m Matches) Add(p image.Point) Matches {
+	for i := range m {
+		m[i] = m[i].Add(p)
+	}
+	return m
+}
+
+// ErrNoMatches is returned by Find if no scale produced any matches, e.g.
+// because they all scored below Options.Threshold.
+var ErrNoMatches = errors.New("no scale produced matches")
+
+// ErrInvalidScale is returned by Find if the scale options are invalid.
+var ErrInvalidScale = errors.New("invalid scale range")
+
+// ErrInvalidWidth is returned by Find if Options.ImageMinWidth is larger than
+// Options.ImageMaxWidth.
+var ErrInvalidWidth = errors.New("invalid image width range")
+
+// ErrInvalidAngle is returned by Find if Options.AngleStep is invalid.
+var ErrInvalidAngle = errors.New("invalid angle step")
+
+// ErrInvalidFlip is returned by Find if Options.Flip is not one of the Flip
+// constants.
+var ErrInvalidFlip = errors.New("invalid flip")
+
+// ErrInvalidMetric is returned by Find if Options.Metric is not one of the
+// Metric constants.
+var ErrInvalidMetric = errors.New("invalid metric")
+
+// ErrInvalidBackend is returned by Find if Options.Backend is not one of the
+// Backend constants.
+var ErrInvalidBackend = errors.New("invalid backend")
+
+// ErrInvalidROI is returned by Find if Options.ROI does not overlap the
+// haystack.
+var ErrInvalidROI = errors.New("region of interest outside of haystack")
+
+// ErrNeedleTooLarge is wrapped by SizeError.
+var ErrNeedleTooLarge = errors.New("needle does not fit into haystack")
+
+// SizeError is returned by Find if the needle is not smaller than the
+// haystack, or too large to be searched at any of the haystack scales.
+type SizeError struct {
+	Haystack image.Point
+	Needle   image.Point
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf(
+		"needle %dx%d does not fit into haystack %dx%d",
+		e.Needle.X, e.Needle.Y, e.Haystack.X, e.Haystack.Y,
+	)
+}
+
+func (e *SizeError) Unwrap() error {
+	return ErrNeedleTooLarge
+}
+
+// Find returns the best matches of needle in haystack, sorted by score.
+//
+// If the needle does not fit into the haystack, a *SizeError is returned,
+// unless Options.Swap is set. If no matches are found, ErrNoMatches is
+// returned. If ctx is cancelled or its deadline is exceeded, the best matches
+// found so far are returned along with ctx.Err().
+func Find(ctx context.Context, haystack image.Image, needle image.Image, opts Options) (Matches, error) {
+	if opts.Swap && swapped(haystack, needle, opts) {
+		return findSwapped(ctx, haystack, needle, opts)
+	}
+
+	pyr, err := newROIPyramid(haystack, opts.ROI)
+	if err != nil {
+		return nil, err
+	}
+	haystack = pyr.src
+
+	opts = opts.withDefaults(haystack)
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkSize(haystack, needle, opts); err != nil {
+		return nil, err
+	}
+
+	if err := printHeader(opts.HTML, haystack, needle); err != nil {
+		return nil, err
+	}
+
+	matches, err := search(ctx, pyr, needle, opts)
+	matches = matches.Add(pyr.offset)
+	if err != nil && !errors.Is(err, ErrNoMatches) {
+		return matches, err
+	}
+
+	if err := printResult(opts, pyr, matches); err != nil {
+		return matches, err
+	}
+
+	if err := printFooter(opts.HTML); err != nil {
+		return matches, err
+	}
+
+	return matches, err
+}
+
+// FindFrames returns the best matches of needle in any of the frames of an
+// animated haystack, sorted by score, with Match.Frame set to the index of
+// their frame. Every frame is searched as with Find, and the errors are the
+// same.
+func FindFrames(ctx context.Context, frames []image.Image, needle image.Image, opts Options) (Matches, error) {
+	// Matches in different frames never overlap, so only the best ones are
+	// kept
+	sel := selection{k: opts.K, threshold: noThreshold}
+	if opts.K == 0 && opts.Threshold == 0 {
+		sel.k = DefaultOptions.K
+	}
+
+	var all Matches
+	for i, frame := range frames {
+		matches, err := Find(ctx, frame, needle, opts)
+		for j := range matches {
+			matches[j].Frame = i
+		}
+		all = append(all, matches...)
+		if err != nil && !errors.Is(err, ErrNoMatches) {
+			return sel.apply(all), err
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, ErrNoMatches
+	}
+	return sel.apply(all), nil
+}
+
+// Needle is a named subimage to search for with FindMany.
+type Needle struct {
+	Name  string
+	Image image.Image
+}
+
+// Result is the outcome of searching for one of the needles in FindMany.
+type Result struct {
+	Name    string  `json:"name"`
+	Matches Matches `json:"matches"`
+	// ErrNoMatches or a *SizeError if the needle was not found, see Find
+	Err error `json:"-"`
+}
+
+// FindMany returns the best matches of every needle in haystack, in the order
+// of needles. It is equivalent to calling Find for each of them, but the
+// haystack is only resized once for all of them.
+//
+// Errors specific to a needle are reported in its Result. If ctx is cancelled
+// or its deadline is exceeded, the results so far are returned along with
+// ctx.Err(), the last one holding the best matches found for its needle.
+func FindMany(ctx context.Context, haystack image.Image, needles []Needle, opts Options) ([]Result, error) {
+	pyr, err := newROIPyramid(haystack, opts.ROI)
+	if err != nil {
+		return nil, err
+	}
+	src := haystack
+	haystack = pyr.src
+
+	opts = opts.withDefaults(haystack)
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := printHeader(opts.HTML, haystack, nil); err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(needles))
+	for _, needle := range needles {
+		result := Result{Name: needle.Name}
+		if opts.Swap && swapped(src, needle.Image, opts) {
+			// The needle is the haystack, so it has its own pyramid and no
+			// HTML output
+			swapOpts := opts
+			swapOpts.HTML = nil
+			matches, err := findSwapped(ctx, src, needle.Image, swapOpts)
+			result.Matches = matches
+			if errors.Is(err, ErrNoMatches) || errors.Is(err, ErrNeedleTooLarge) {
+				result.Err = err
+			} else if err != nil {
+				return append(results, result), err
+			}
+			results = append(results, result)
+			continue
+		}
+		if err := checkSize(haystack, needle.Image, opts); err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+
+		if opts.HTML != nil {
+			err := templates.needle.Execute(opts.HTML, struct {
+				Name     string
+				Subimage image.Image
+			}{
+				Name:     needle.Name,
+				Subimage: needle.Image,
+			})
+			if err != nil {
+				return results, fmt.Errorf("failed to execute template: %w", err)
+			}
+		}
+
+		matches, err := search(ctx, pyr, needle.Image, opts)
+		matches = matches.Add(pyr.offset)
+		result.Matches = matches
+		if errors.Is(err, ErrNoMatches) || errors.Is(err, ErrNeedleTooLarge) {
+			result.Err = err
+		} else if err != nil {
+			return append(results, result), err
+		}
+		results = append(results, result)
+
+		if err := printResult(opts, pyr, matches); err != nil {
+			return results, err
+		}
+	}
+
+	if err := printFooter(opts.HTML); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// swapped returns true if the needle does not fit into the haystack, but the
+// haystack fits into the needle.
+func swapped(haystack image.Image, needle image.Image, opts Options) bool {
+	return checkSize(haystack, needle, opts.withDefaults(haystack)) != nil &&
+		checkSize(needle, haystack, opts.withDefaults(needle)) == nil
+}
+
+// findSwapped searches for the haystack in the needle, see Options.Swap.
+func findSwapped(ctx context.Context, haystack image.Image, needle image.Image, opts Options) (Matches, error) {
+	opts.Swap = false
+	matches, err := Find(ctx, needle, haystack, opts)
+	for i := range matches {
+		matches[i].Swapped = true
+	}
+	return matches, err
+}
+
+// checkSize returns a *SizeError if the needle is not smaller than the
+// haystack at the smallest scale searched and any of the angles.
+func checkSize(haystack image.Image, needle image.Image, opts Options) error {
+	hs := haystack.Bounds().Size()
+	ns := needle.Bounds().Size()
+	scale := 1.0
+	if opts.scaleSearch() {
+		scale = math.Min(1, opts.ScaleMin)
+	}
+	angles := opts.angles()
+	if angles == nil {
+		angles = []float64{0}
+	}
+	for _, angle := range angles {
+		rs := rotatedSize(ns, angle)
+		if float64(rs.X)*scale < float64(hs.X) && float64(rs.Y)*scale < float64(hs.Y) {
+			return nil
+		}
+	}
+	return &SizeError{Haystack: hs, Needle: ns}
+}
+
+// search returns the best matches of the needle, flipped and rotated by
+// every orientation and angle searched.
+func search(ctx context.Context, pyr *pyramid, needle image.Image, opts Options) (Matches, error) {
+	flips := opts.Flip.flips()
+	angles := opts.angles()
+	if len(flips) == 1 && angles == nil {
+		return find(ctx, pyr, needle, opts)
+	}
+	if angles == nil {
+		angles = []float64{0}
+	}
+
+	size := needle.Bounds().Size()
+	var all Matches
+	// ErrNeedleTooLarge if none of the variants fit into the haystack
+	var notFound error
+	for _, flip := range flips {
+		flipped := needle
+		if flip != FlipNone {
+			flipped = flipImage(needle, flip)
+		}
+		for _, angle := range angles {
+			if opts.Verbose {
+				log.Printf("flip: %s, angle: %g\n", flip, angle)
+			}
+			subsrc := flipped
+			if opts.AngleStep != 0 {
+				subsrc = rotateImage(flipped, angle)
+			}
+			matches, err := find(ctx, pyr, subsrc, opts)
+			for i := range matches {
+				if opts.Flip != "" {
+					matches[i].Flip = flip
+				}
+				if opts.AngleStep != 0 {
+					matches[i].Angle = angle
+					matches[i].Polygon = polygon(matches[i], size)
+				}
+			}
+			all = append(all, matches...)
+			switch {
+			case errors.Is(err, ErrNeedleTooLarge):
+				if notFound == nil {
+					notFound = err
+				}
+			case errors.Is(err, ErrNoMatches):
+				notFound = err
+			case err != nil:
+				return opts.selection(1).apply(all), err
+			}
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, notFound
+	}
+	return opts.selection(1).apply(all), nil
+}
+
+// withDefaults returns the options with the unset ones replaced by
+// DefaultOptions and the limits adjusted to the haystack.
+func (opts Options) withDefaults(haystack image.Image) Options {
+	if opts.ImageMinWidth == 0 {
+		opts.ImageMinWidth = DefaultOptions.ImageMinWidth
+	}
+
+	if opts.ImageMaxWidth == 0 {
+		opts.ImageMaxWidth = DefaultOptions.ImageMaxWidth
+	}
+
+	if opts.SubimageMinArea == 0 {
+		opts.SubimageMinArea = DefaultOptions.SubimageMinArea
+	}
+
+	if opts.SubimageMaxDiv == 0 {
+		opts.SubimageMaxDiv = DefaultOptions.SubimageMaxDiv
+	}
+
+	// With a threshold, all the matches above it are returned
+	if opts.K == 0 && opts.Threshold == 0 {
+		opts.K = DefaultOptions.K
+	}
+
+	if opts.Backend == "" {
+		opts.Backend = DefaultOptions.Backend
+	}
+
+	if opts.Metric == "" {
+		opts.Metric = DefaultOptions.Metric
+	}
+
+	if opts.scaleSearch() {
+		if opts.ScaleMin == 0 {
+			opts.ScaleMin = 1
+		}
+		if opts.ScaleMax == 0 {
+			opts.ScaleMax = 1
+		}
+	}
+
+	if opts.ScaleStep == 0 {
+		opts.ScaleStep = DefaultOptions.ScaleStep
+	}
+
+	// Haystacks narrower than the widths are searched at their own width
+	if w := haystack.Bounds().Dx(); w < opts.ImageMaxWidth {
+		if opts.ImageMinWidth > w && opts.ImageMinWidth <= opts.ImageMaxWidth {
+			opts.ImageMinWidth = w
+		}
+		opts.ImageMaxWidth = w
+	}
+
+	return opts
+}
+
+func (opts Options) validate() error {
+	if opts.ImageMinWidth < 0 || opts.ImageMinWidth > opts.ImageMaxWidth {
+		return fmt.Errorf("%w: %d to %d", ErrInvalidWidth, opts.ImageMinWidth, opts.ImageMaxWidth)
+	}
+	if opts.ScaleMin < 0 || opts.ScaleMax < 0 || opts.ScaleMin > opts.ScaleMax {
+		return fmt.Errorf("%w: %v to %v", ErrInvalidScale, opts.ScaleMin, opts.ScaleMax)
+	}
+	if opts.ScaleStep <= 1 {
+		return fmt.Errorf("%w: step %v is not larger than 1", ErrInvalidScale, opts.ScaleStep)
+	}
+	switch opts.Flip {
+	case "", FlipNone, FlipH, FlipV, FlipBoth:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidFlip, opts.Flip)
+	}
+	if opts.AngleStep < 0 || opts.AngleStep > 360 {
+		return fmt.Errorf("%w: %v is not between 0 and 360", ErrInvalidAngle, opts.AngleStep)
+	}
+	switch opts.Metric {
+	case MetricSAD, MetricSSD, MetricZNCC:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidMetric, opts.Metric)
+	}
+	switch opts.Backend {
+	case BackendDirect, BackendFFT:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidBackend, opts.Backend)
+	}
+	return nil
+}
+
+// angles returns the rotations of the subimage searched in degrees, or nil
+// if rotations are not searched.
+func (opts Options) angles() []float64 {
+	if opts.AngleStep == 0 {
+		return nil
+	}
+	var angles []float64
+	for i := 0; float64(i)*opts.AngleStep < 360-1e-9; i++ {
+		angles = append(angles, float64(i)*opts.AngleStep)
+	}
+	return angles
+}
+
+// scaleSearch returns true if the subimage is searched at every scale
+// between ScaleMin and ScaleMax instead of power of two divisions.
+// widths returns the widths the haystack is searched at, doubling from
+// ImageMinWidth and ending at ImageMaxWidth.
+func (opts Options) widths() []int {
+	var widths []int
+	for w := opts.ImageMinWidth; w < opts.ImageMaxWidth; w *= 2 {
+		widths = append(widths, w)
+	}
+	return append(widths, opts.ImageMaxWidth)
+}
+
+func (opts Options) scaleSearch() bool {
+	return opts.ScaleMin > 0 || opts.ScaleMax > 0
+}
+
+// scales returns the subimage scales searched, from the largest to the
+// smallest. With scaleSearch, they are evenly spaced in log space and at most
+// ScaleStep apart.
+func (opts Options) scales() []float64 {
+	if !opts.scaleSearch() {
+		var scales []float64
+		for div := 1; div <= opts.SubimageMaxDiv; div *= 2 {
+			scales = append(scales, 1/float64(div))
+		}
+		return scales
+	}
+	n := int(math.Ceil(math.Log(opts.ScaleMax/opts.ScaleMin)/math.Log(opts.ScaleStep) - 1e-9))
+	if n < 1 {
+		return []float64{opts.ScaleMax}
+	}
+	scales := make([]float64, n+1)
+	for i := range scales {
+		scales[i] = opts.ScaleMax * math.Pow(opts.ScaleMin/opts.ScaleMax, float64(i)/float64(n))
+	}
+	return scales
+}
+
+func printHeader(w io.Writer, haystack image.Image, needle image.Image) error {
+	if w == nil {
+		return nil
+	}
+	if err := loadTemplates(); err != nil {
+		return err
+	}
+	err := templates.header.Execute(w, struct {
+		Image    image.Image
+		Subimage image.Image
+	}{
+		Image:    haystack,
+		Subimage: needle,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	return nil
+}
+
+// printResult prints the matches found, visualized on the largest haystack
+// level searched.
+func printResult(opts Options, pyr *pyramid, matches Matches) error {
+	if opts.HTML == nil {
+		return nil
+	}
+	img := pyr.level(opts.ImageMaxWidth)
+	scale := float64(opts.ImageMaxWidth) / float64(pyr.src.Bounds().Dx())
+	scaled := make(Matches, len(matches))
+	copy(scaled, matches)
+	scaled = scaled.Add(pyr.offset.Mul(-1)).Scale(scale)
+	err := templates.result.Execute(opts.HTML, struct {
+		Visualized image.Image
+		Matches    Matches
+	}{
+		Visualized: visualizeMatches(img, scaled),
+		Matches:    matches,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	return nil
+}
+
+func printFooter(w io.Writer) error {
+	if w == nil {
+		return nil
+	}
+	if err := templates.footer.Execute(w, nil); err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	return nil
+}
+
+func find(ctx context.Context, pyr *pyramid, subsrc image.Image, opts Options) (Matches, error) {
+	imgsrc := pyr.src
+
+	var matches Matches
+	matchWidth := 0
+	scales := opts.scales()
+
+	// With scaleSearch, the top match of the best image width so far
+	bestTopMatch := math.Inf(-1)
+
+	// Whether any subimage scale was searched, and if not, whether it was
+	// because they were too large
+	searched := false
+	tooLarge := false
+
+	for _, imgWidth := range opts.widths() {
+		if err := ctx.Err(); err != nil {
+			return opts.selection(1).apply(matches), err
+		}
+
+		img := pyr.level(imgWidth)
+		imgHeight := img.Bounds().Dy()
+		imgScale := float64(imgWidth) / float64(imgsrc.Bounds().Dx())
+
+		lastTopMatch := math.Inf(-1)
+
+		run := run{
+			Size:   image.Point{X: imgWidth, Y: imgHeight},
+			Metric: opts.Metric,
+		}
+
+		done := false
+
+		// With scaleSearch, the matches of all the scales are merged
+		var scaleMatches Matches
+		// Subrun of the best matches so far
+		bestSubrun := -1
+
+		for _, sscale := range scales {
+			sw := int(math.Round(float64(subsrc.Bounds().Dx()) * sscale * imgScale))
+			sh := int(math.Round(float64(subsrc.Bounds().Dy()) * sscale * imgScale))
+			sarea := sw * sh
+			if sarea < opts.SubimageMinArea || sw >= imgWidth || sh >= imgHeight {
+				if opts.Verbose {
+					log.Printf("image size: %dx%d, subimage size: %dx%d, scale: %.3f, skipping\n", imgWidth, imgHeight, sw, sh, sscale)
+				}
+				if sarea >= opts.SubimageMinArea {
+					tooLarge = true
+					// Smaller scales might still fit
+					if opts.scaleSearch() {
+						continue
+					}
+				}
+				break
+			}
+			searched = true
+
+			subimg := resizeImage(subsrc, sw, sh)
+			subrun := subrun{
+				Image:    img,
+				Subimage: subimg,
+			}
+
+			if opts.HTML != nil {
+				conv, err := convolutionParallel(ctx, img, subimg, opts.Metric)
+				if err != nil {
+					return opts.selection(1).apply(matches), err
+				}
+				subrun.Convolution = conv
+			}
+
+			// Distances are in original pixels
+			sel := opts.candidates(imgScale)
+
+			var divMatches Matches
+			var err error
+			switch opts.Backend {
+			case BackendFFT:
+				divMatches, err = convolutionTopKFFT(ctx, pyr.fftLevel(imgWidth), subimg, opts.Metric, sel)
+			default:
+				divMatches, err = convolutionTopKParallel(ctx, img, subimg, opts.Metric, sel)
+			}
+			for i := range divMatches {
+				divMatches[i].SubimageScale = sscale
+			}
+			if err != nil {
+				// Return the best matches so far, which are the partial
+				// ones if this is the first scale
+				if len(matches) == 0 {
+					localizeSubpixel(img, subimg, divMatches, opts.Metric)
+					matches = divMatches.Scale(1 / imgScale)
+					if opts.scaleSearch() {
+						matches = opts.candidates(1).apply(append(scaleMatches, matches...))
+					}
+				}
+				return opts.selection(1).apply(matches), err
+			}
+			if len(divMatches) == 0 {
+				subrun.Skipped = true
+				subrun.Reason = "no matches"
+				run.Subruns = append(run.Subruns, subrun)
+				if opts.scaleSearch() {
+					continue
+				}
+				break
+			}
+
+			localizeSubpixel(img, subimg, divMatches, opts.Metric)
+
+			divTopMatch := divMatches[0]
+			if opts.Verbose {
+				log.Printf("image size: %dx%d, subimage size: %dx%d, scale: %.3f, match: %f %v\n", imgWidth, imgHeight, sw, sh, sscale, divTopMatch.Match, divTopMatch.Bounds)
+			}
+			if opts.HTML != nil {
+				subrun.Visualized = visualizeMatches(img, divMatches)
+			}
+
+			subrun.Matches = divMatches.Scale(1 / imgScale)
+			run.Subruns = append(run.Subruns, subrun)
+
+			if opts.scaleSearch() {
+				if bestSubrun < 0 || divTopMatch.Match > lastTopMatch {
+					lastTopMatch = divTopMatch.Match
+					bestSubrun = len(run.Subruns) - 1
+				}
+				scaleMatches = append(scaleMatches, divMatches...)
+				continue
+			}
+
+			if divTopMatch.Match < lastTopMatch {
+				run.Subruns[bestSubrun].Selected = true
+				done = true
+				break
+			}
+			lastTopMatch = divTopMatch.Match
+			bestSubrun = len(run.Subruns) - 1
+			matches = divMatches
+			matchWidth = imgWidth
+		}
+
+		if len(scaleMatches) > 0 {
+			// Like with divisions, stop at the first image width that does
+			// not improve on the previous ones and keep their matches
+			if lastTopMatch < bestTopMatch {
+				done = true
+			} else {
+				bestTopMatch = lastTopMatch
+				// Distances are already in original pixels
+				matches = opts.candidates(1).apply(scaleMatches)
+				matchWidth = imgWidth
+				run.Subruns[bestSubrun].Selected = true
+			}
+		}
+
+		if opts.HTML != nil {
+			if err := run.PrintHTML(opts.HTML, templates.run); err != nil {
+				return opts.selection(1).apply(matches), err
+			}
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if !searched && tooLarge {
+		return nil, &SizeError{
+			Haystack: imgsrc.Bounds().Size(),
+			Needle:   subsrc.Bounds().Size(),
+		}
+	}
+
+	if opts.Refine {
+		var err error
+		matches, err = refineMatches(ctx, pyr, subsrc, matches, matchWidth, opts)
+		if err != nil {
+			return matches, err
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, ErrNoMatches
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,1596 @@
+package match
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func openImage(filename string) (image.Image, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+func createSubImage(img image.Image, r image.Rectangle) image.Image {
+	subimg := image.NewRGBA(r)
+	draw.Draw(subimg, r, img, r.Min, draw.Src)
+	return subimg
+}
+
+func TestFindImage(t *testing.T) {
+	// Create test images
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rect := image.Rect(66, 287, 121, 327)
+
+	subsrc := createSubImage(imgsrc, rect)
+
+	// Define test options
+	opts := Options{
+		ImageMinWidth:   8,
+		ImageMaxWidth:   128,
+		SubimageMinArea: 5 * 5,
+		Verbose:         true,
+	}
+
+	// Find image
+	matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Check results
+	if len(matches) < 1 {
+		t.Fatal("No matches found")
+	}
+
+	itr := matches[0].Bounds.Intersect(rect)
+	if itr.Empty() {
+		t.Fatal("No intersection found")
+	}
+
+	if itr.Dx() < 5 || itr.Dy() < 5 {
+		t.Fatal("Intersection too small")
+	}
+
+	println("Found match:", matches[0].Bounds.String())
+}
+
+func TestImageWidths(t *testing.T) {
+	tests := []struct {
+		min, max int
+		want     []int
+	}{
+		{8, 128, []int{8, 16, 32, 64, 128}},
+		{128, 496, []int{128, 256, 496}},
+		{496, 496, []int{496}},
+	}
+	for _, tt := range tests {
+		got := Options{ImageMinWidth: tt.min, ImageMaxWidth: tt.max}.widths()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d to %d: expected %v, got %v", tt.min, tt.max, tt.want, got)
+		}
+	}
+}
+
+func TestFindImageWidths(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	// Both widths are clamped to the haystack, which is searched at full
+	// width and finds the exact bounds without refining
+	opts := Options{ImageMinWidth: 3840, ImageMaxWidth: 3840, Backend: BackendFFT}
+	matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[0].Bounds != rect {
+		t.Errorf("expected %v, got %v", rect, matches[0].Bounds)
+	}
+
+	opts = Options{ImageMinWidth: 300, ImageMaxWidth: 200}
+	if _, err := Find(context.Background(), imgsrc, subsrc, opts); !errors.Is(err, ErrInvalidWidth) {
+		t.Errorf("expected ErrInvalidWidth, got %v", err)
+	}
+}
+
+func TestFindImageRandom(t *testing.T) {
+	// Create test images
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := imgsrc.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	rnd := rand.New(rand.NewSource(0))
+
+	for i := 0; i < 10; i++ {
+		// Create random rectangle
+		x := rnd.Intn(w - 1)
+		y := rnd.Intn(h - 1)
+		sw := rnd.Intn(w-1-x) + 1
+		sh := rnd.Intn(h-1-y) + 1
+		rect := image.Rect(x, y, x+sw, y+sh)
+
+		subsrc := createSubImage(imgsrc, rect)
+
+		// Define test options
+		opts := Options{
+			ImageMinWidth:   8,
+			ImageMaxWidth:   128,
+			SubimageMinArea: 5 * 5,
+			K:               1,
+			Verbose:         true,
+		}
+
+		// Find image
+		matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		// Check results
+		if len(matches) < 1 {
+			t.Error("No matches found")
+			continue
+		}
+
+		itr := matches[0].Bounds.Intersect(rect)
+		if itr.Empty() {
+			t.Errorf("No intersection found: %s", matches[0].Bounds.String())
+			continue
+		}
+
+		if itr.Dx() < 5 || itr.Dy() < 5 {
+			t.Error("Intersection too small")
+			continue
+		}
+		println("Found match:", matches[0].Bounds.String())
+	}
+}
+
+func TestFindImageRandomPatches(t *testing.T) {
+	// Create test images
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := imgsrc.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	rnd := rand.New(rand.NewSource(0))
+
+	for i := 0; i < 30; i++ {
+		// Create random rectangle
+		sw := 200
+		sh := 150
+		x := rnd.Intn(w - 1 - sw)
+		y := rnd.Intn(h - 1 - sh)
+		rect := image.Rect(x, y, x+sw, y+sh)
+
+		subsrc := createSubImage(imgsrc, rect)
+
+		// Define test options
+		opts := Options{
+			K: 1,
+			// html:        true,
+			// convolution: true,
+			// visualize:   true,
+		}
+
+		// Find image
+		matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		// Check results
+		if len(matches) < 1 {
+			t.Error("No matches found")
+			continue
+		}
+
+		itr := matches[0].Bounds.Intersect(rect)
+		if itr.Empty() {
+			t.Errorf("No intersection found: expected %s got %s", rect.String(), matches[0].Bounds.String())
+			continue
+		}
+
+		if itr.Dx() < 5 || itr.Dy() < 5 {
+			t.Error("Intersection too small")
+			continue
+		}
+		t.Log("Found match:", matches[0].Bounds.String())
+	}
+}
+
+func BenchmarkFindImageRandomPatches(b *testing.B) {
+	// Create test images
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	bounds := imgsrc.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	rnd := rand.New(rand.NewSource(0))
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		// Create random rectangle
+		sw := 200
+		sh := 150
+		x := rnd.Intn(w - 1 - sw)
+		y := rnd.Intn(h - 1 - sh)
+		rect := image.Rect(x, y, x+sw, y+sh)
+
+		subsrc := createSubImage(imgsrc, rect)
+
+		// Define test options
+		opts := Options{
+			K: 1,
+		}
+
+		// Find image
+		b.StartTimer()
+		matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+		b.StopTimer()
+		if err != nil {
+			b.Error(err)
+			continue
+		}
+
+		// Check results
+		if len(matches) < 1 {
+			b.Error("No matches found")
+			continue
+		}
+
+		itr := matches[0].Bounds.Intersect(rect)
+		if itr.Empty() {
+			b.Errorf("No intersection found: expected %s got %s", rect.String(), matches[0].Bounds.String())
+			continue
+		}
+
+		if itr.Dx() < 5 || itr.Dy() < 5 {
+			b.Error("Intersection too small")
+			continue
+		}
+		b.Log("Found match:", matches[0].Bounds.String())
+	}
+}
+
+func FuzzFindImage(f *testing.F) {
+
+	// Create test images
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(66, 287, 121, 327)
+	f.Fuzz(func(t *testing.T, a int, b int, c int, d int) {
+		rect := image.Rect(a, b, c, d)
+
+		subsrc := createSubImage(imgsrc, rect)
+
+		// Define test options
+		opts := Options{
+			ImageMinWidth:   8,
+			ImageMaxWidth:   128,
+			SubimageMinArea: 5 * 5,
+		}
+
+		// Find image
+		matches, err := Find(context.Background(), imgsrc, subsrc, opts)
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Check results
+		if len(matches) < 1 {
+			t.Error("No matches found")
+		}
+
+		itr := matches[0].Bounds.Intersect(rect)
+		if itr.Empty() {
+			t.Error("No intersection found")
+		}
+
+		if itr.Dx() < 5 || itr.Dy() < 5 {
+			t.Error("Intersection too small")
+		}
+
+		println("Found match:", matches[0].Bounds.String())
+	})
+}
+
+func TestConvolutionTopKFFT(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := resizeImage(imgsrc, 128, 0)
+	rect := image.Rect(40, 30, 60, 46)
+	subimg := resizeImage(createSubImage(img, rect), rect.Dx(), rect.Dy())
+
+	k := 6
+	for _, metric := range []Metric{MetricSAD, MetricSSD, MetricZNCC} {
+		direct, _ := convolutionTopKParallel(context.Background(), img, subimg, metric, selection{k: k})
+		fft, _ := convolutionTopKFFT(context.Background(), newFFTImage(img), subimg, metric, selection{k: k})
+
+		if len(fft) != len(direct) {
+			t.Fatalf("%s: expected %d matches, got %d", metric, len(direct), len(fft))
+		}
+
+		if fft[0].Bounds != rect {
+			t.Errorf("%s: expected top match at %s, got %s", metric, rect, fft[0].Bounds)
+		}
+
+		for i := range direct {
+			if math.Abs(fft[i].Match-direct[i].Match) > 1e-3 {
+				t.Errorf("%s: match %d: expected %f got %f", metric, i, direct[i].Match, fft[i].Match)
+			}
+		}
+	}
+}
+
+func TestConvolutionTopKFFTNMS(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := resizeImage(imgsrc, 128, 0)
+	rect := image.Rect(40, 30, 60, 46)
+	subimg := resizeImage(createSubImage(img, rect), rect.Dx(), rect.Dy())
+
+	sels := []selection{
+		{k: 6, threshold: noThreshold, nms: nms{iou: 0.3}},
+		{k: 6, threshold: noThreshold, nms: nms{dist: 10}},
+		{k: 6, threshold: noThreshold, nms: nms{disjoint: true}},
+	}
+	for _, metric := range []Metric{MetricSAD, MetricSSD, MetricZNCC} {
+		for _, sel := range sels {
+			direct, _ := convolutionTopKParallel(context.Background(), img, subimg, metric, sel)
+			fft, _ := convolutionTopKFFT(context.Background(), newFFTImage(img), subimg, metric, sel)
+
+			if len(fft) != len(direct) {
+				t.Fatalf("%s %+v: expected %d matches, got %d", metric, sel.nms, len(direct), len(fft))
+			}
+			for i := range direct {
+				if fft[i].Bounds != direct[i].Bounds || math.Abs(fft[i].Match-direct[i].Match) > 1e-6 {
+					t.Errorf("%s %+v: match %d: expected %v %f got %v %f", metric, sel.nms, i, direct[i].Bounds, direct[i].Match, fft[i].Bounds, fft[i].Match)
+				}
+			}
+		}
+	}
+}
+
+func TestCrossCorrelationFFT(t *testing.T) {
+	// Image and subimage sizes, including odd and single row grids
+	sizes := [][4]int{{5, 1, 2, 1}, {1, 4, 1, 2}, {7, 3, 3, 2}, {9, 6, 4, 5}}
+	for _, size := range sizes {
+		img := image.NewRGBA(image.Rect(3, 2, 3+size[0], 2+size[1]))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i*37%251 + 1)
+		}
+		subimg := image.NewRGBA(image.Rect(0, 0, size[2], size[3]))
+		for i := range subimg.Pix {
+			subimg.Pix[i] = uint8(i*53%241 + 3)
+		}
+
+		fimg := newFFTImage(img)
+		corr, err := crossCorrelationFFT(context.Background(), fimg, subimg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y+size[3] <= size[1]; y++ {
+			for x := 0; x+size[2] <= size[0]; x++ {
+				want := 0.
+				for j := 0; j < size[3]; j++ {
+					for i := 0; i < size[2]; i++ {
+						for c := 0; c < 3; c++ {
+							a := img.Pix[img.PixOffset(3+x+i, 2+y+j)+c]
+							b := subimg.Pix[subimg.PixOffset(i, j)+c]
+							want += float64(a) * float64(b)
+						}
+					}
+				}
+				if got := corr.at(x, y); math.Abs(got-want) > 1e-6 {
+					t.Errorf("%v: expected %f at %d,%d, got %f", size, want, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestFindBackendsNMS(t *testing.T) {
+	img, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subimg, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{K: 6, NMSIoU: 0.3}
+	direct, err := Find(context.Background(), img, subimg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Backend = BackendFFT
+	fft, err := Find(context.Background(), img, subimg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(direct) != opts.K || len(fft) != opts.K {
+		t.Fatalf("expected %d matches, got %d direct and %d fft", opts.K, len(direct), len(fft))
+	}
+	for i := range direct {
+		if fft[i].Bounds != direct[i].Bounds || math.Abs(fft[i].Match-direct[i].Match) > 1e-6 {
+			t.Errorf("match %d: expected %v %f got %v %f", i, direct[i].Bounds, direct[i].Match, fft[i].Bounds, fft[i].Match)
+		}
+	}
+}
+
+func TestConvolutionTopKOrigin(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A level with a non-zero origin and the match in the bottom rows
+	level := resizeImage(imgsrc, 128, 0)
+	img := image.NewRGBA(level.Bounds().Add(image.Pt(40, 30)))
+	draw.Draw(img, img.Bounds(), level, image.Point{}, draw.Src)
+	h := level.Bounds().Dy()
+	rect := image.Rect(60, h-18, 80, h-2).Add(img.Bounds().Min)
+	subimg := toRGBA(img.SubImage(rect))
+
+	for _, metric := range []Metric{MetricSAD, MetricZNCC} {
+		direct, _ := convolutionTopKParallel(context.Background(), img, subimg, metric, selection{k: 1})
+		fft, _ := convolutionTopKFFT(context.Background(), newFFTImage(img), subimg, metric, selection{k: 1})
+		if len(direct) != 1 || direct[0].Bounds != rect {
+			t.Errorf("%s direct: expected %v, got %v", metric, rect, direct)
+		}
+		if len(fft) != 1 || fft[0].Bounds != rect {
+			t.Errorf("%s fft: expected %v, got %v", metric, rect, fft)
+		}
+	}
+}
+
+func TestMetricZNCCBrightness(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := resizeImage(imgsrc, 128, 0)
+	rect := image.Rect(40, 30, 60, 46)
+	subimg := resizeImage(createSubImage(img, rect), rect.Dx(), rect.Dy())
+
+	// Darken and reduce the contrast of the subimage
+	for i := range subimg.Pix {
+		if i%4 != 3 {
+			subimg.Pix[i] = subimg.Pix[i]/2 + 10
+		}
+	}
+
+	matches, _ := convolutionTopKParallel(context.Background(), img, subimg, MetricZNCC, selection{k: 1})
+	if matches[0].Bounds != rect {
+		t.Errorf("expected top match at %s, got %s", rect, matches[0].Bounds)
+	}
+	if matches[0].Match < 0.99 {
+		t.Errorf("expected match above 0.99, got %f", matches[0].Match)
+	}
+}
+
+func TestMetricZNCCNegative(t *testing.T) {
+	// A horizontal gradient and the subimage mirrored, which is negatively
+	// correlated everywhere
+	img := image.NewRGBA(image.Rect(0, 0, 120, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 120; x++ {
+			img.Set(x, y, color.Gray{uint8(x * 2)})
+		}
+	}
+	subimg := flipImage(img.SubImage(image.Rect(10, 10, 30, 30)), FlipH)
+
+	matches, err := Find(context.Background(), img, subimg, Options{K: 1, Metric: MetricZNCC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matches[0].Match; m > -0.99 {
+		t.Errorf("expected match around -1, got %f", m)
+	}
+}
+
+func TestFindImageRefine(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rects := []image.Rectangle{
+		image.Rect(271, 109, 371, 207),
+		image.Rect(37, 201, 113, 260),
+		image.Rect(300, 20, 450, 130),
+	}
+
+	for _, rect := range rects {
+		subsrc := createSubImage(imgsrc, rect)
+
+		matches, err := Find(context.Background(), imgsrc, subsrc, Options{
+			K:      1,
+			Refine: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(matches) < 1 {
+			t.Error("No matches found")
+			continue
+		}
+
+		if matches[0].Bounds != rect {
+			t.Errorf("expected %s got %s", rect, matches[0].Bounds)
+		}
+	}
+}
+
+func TestFindImageRefineK(t *testing.T) {
+	img, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subimg, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The top candidates are neighbors that converge to the same occurrence
+	// when refined, so the next ones have to be refined instead
+	for _, opts := range []Options{
+		{K: 3, Refine: true},
+		{K: 3, Refine: true, NMSIoU: 0.3},
+	} {
+		matches, err := Find(context.Background(), img, subimg, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != opts.K {
+			t.Fatalf("nms %g: expected %d matches, got %d", opts.NMSIoU, opts.K, len(matches))
+		}
+		for i, m := range matches {
+			for _, o := range matches[:i] {
+				if opts.NMSIoU == 0 && m.Bounds.Overlaps(o.Bounds) {
+					t.Errorf("nms %g: match %v overlaps %v", opts.NMSIoU, m.Bounds, o.Bounds)
+				}
+				if opts.NMSIoU > 0 && iou(m.Bounds, o.Bounds) > opts.NMSIoU {
+					t.Errorf("nms %g: match %v overlaps %v by %f", opts.NMSIoU, m.Bounds, o.Bounds, iou(m.Bounds, o.Bounds))
+				}
+			}
+		}
+	}
+}
+
+func TestFindImageScale(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	for _, scale := range []float64{0.75, 1.4} {
+		b := imgsrc.Bounds()
+		img := image.NewRGBA(image.Rect(0, 0, int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)))
+		draw.CatmullRom.Scale(img, img.Bounds(), imgsrc, b, draw.Src, nil)
+
+		matches, err := Find(context.Background(), img, subsrc, Options{
+			K:        1,
+			ScaleMin: 0.5,
+			ScaleMax: 2,
+			Refine:   true,
+			Backend:  BackendFFT,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := matches[0]
+		if math.Abs(m.SubimageScale-scale) > 0.1*scale {
+			t.Errorf("scale %v: detected scale %v", scale, m.SubimageScale)
+		}
+		expected := image.Pt(int(float64(rect.Min.X)*scale), int(float64(rect.Min.Y)*scale))
+		if d := m.Bounds.Min.Sub(expected); math.Abs(float64(d.X)) > 3 || math.Abs(float64(d.Y)) > 3 {
+			t.Errorf("scale %v: expected %v got %v", scale, expected, m.Bounds)
+		}
+	}
+
+	// The search stops at the first image width not improving on the top
+	// match, which is the 128px one before the 256px one
+	var html bytes.Buffer
+	_, err = Find(context.Background(), imgsrc, subsrc, Options{
+		K:             1,
+		ScaleMin:      0.5,
+		ScaleMax:      2,
+		ImageMinWidth: 16,
+		ImageMaxWidth: 256,
+		HTML:          &html,
+		Backend:       BackendFFT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Count(html.String(), "<h2>") - 1; runs != 4 {
+		t.Errorf("expected 4 image widths searched, got %d", runs)
+	}
+
+	_, err = Find(context.Background(), imgsrc, subsrc, Options{ScaleMin: 2, ScaleMax: 1})
+	if !errors.Is(err, ErrInvalidScale) {
+		t.Errorf("expected ErrInvalidScale, got %v", err)
+	}
+}
+
+func TestFindImageRotation(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	// Rotated by a right angle, the subimage is found exactly
+	matches, err := Find(context.Background(), imgsrc, rotateImage(subsrc, 90), Options{
+		K:         1,
+		AngleStep: 90,
+		Refine:    true,
+		Backend:   BackendFFT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matches[0]; m.Angle != 270 || m.Bounds != rect {
+		t.Errorf("expected %v at 270, got %v at %v", rect, m.Bounds, m.Angle)
+	}
+
+	// Rotate the subimage in the haystack itself by 30 degrees
+	img := toRGBA(imgsrc)
+	rotated := rotateImage(subsrc, 30)
+	at := image.Pt(150, 80)
+	draw.Draw(img, rotated.Bounds().Add(at), rotated, image.Point{}, draw.Over)
+
+	matches, err = Find(context.Background(), img, subsrc, Options{
+		K:         1,
+		AngleStep: 15,
+		Refine:    true,
+		Backend:   BackendFFT,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := matches[0]
+	if m.Angle != 30 {
+		t.Fatalf("expected angle 30, got %v", m.Angle)
+	}
+	if d := m.Bounds.Min.Sub(at); math.Abs(float64(d.X)) > 2 || math.Abs(float64(d.Y)) > 2 {
+		t.Errorf("expected %v got %v", at, m.Bounds)
+	}
+	if len(m.Polygon) != 4 {
+		t.Fatalf("expected a polygon, got %v", m.Polygon)
+	}
+	// The top-left corner of the subimage is rotated to the top
+	top := m.Polygon[0]
+	for _, p := range m.Polygon {
+		if p.Y < top.Y-1e-9 {
+			t.Errorf("expected the first corner at the top, got %v", m.Polygon)
+		}
+	}
+}
+
+func TestFindImageFlip(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	tests := []struct {
+		flipped Flip
+		search  Flip
+	}{
+		{FlipH, FlipH},
+		{FlipV, FlipBoth},
+		{FlipBoth, FlipBoth},
+	}
+	for _, test := range tests {
+		matches, err := Find(context.Background(), imgsrc, flipImage(subsrc, test.flipped), Options{
+			K:       1,
+			Flip:    test.search,
+			Refine:  true,
+			Backend: BackendFFT,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := matches[0]; m.Flip != test.flipped || m.Bounds != rect {
+			t.Errorf("expected %v flipped %s, got %v flipped %s", rect, test.flipped, m.Bounds, m.Flip)
+		}
+	}
+
+	_, err = Find(context.Background(), imgsrc, subsrc, Options{Flip: "x"})
+	if !errors.Is(err, ErrInvalidFlip) {
+		t.Errorf("expected ErrInvalidFlip, got %v", err)
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	raw := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range raw.Pix {
+		raw.Pix[i] = uint8(i)
+	}
+	rect := image.Rect(1, 0, 3, 2)
+
+	// Pixel displayed at the top left corner for each orientation
+	corners := []image.Point{{0, 0}, {3, 0}, {3, 2}, {0, 2}, {0, 0}, {0, 2}, {3, 2}, {3, 0}}
+	for i, corner := range corners {
+		o := Orientation(i + 1)
+		oriented := o.Apply(raw)
+		size := oriented.Bounds().Size()
+		if o >= 5 && size != image.Pt(3, 4) || o < 5 && size != image.Pt(4, 3) {
+			t.Errorf("orientation %d: unexpected size %v", o, size)
+		}
+		if oriented.At(0, 0) != raw.At(corner.X, corner.Y) {
+			t.Errorf("orientation %d: expected raw pixel %v at the top left", o, corner)
+		}
+
+		// The raw rectangle has the same pixels as the oriented one
+		r := o.Raw(rect, size)
+		colors := map[color.Color]bool{}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				colors[raw.At(x, y)] = true
+			}
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if !colors[oriented.At(x, y)] {
+					t.Errorf("orientation %d: pixel %d,%d not in raw bounds %v", o, x, y, r)
+				}
+			}
+		}
+		if r.Dx()*r.Dy() != rect.Dx()*rect.Dy() {
+			t.Errorf("orientation %d: raw bounds %v differ in size from %v", o, r, rect)
+		}
+	}
+}
+
+func TestFindImageROI(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	roi := image.Rect(200, 50, 450, 250)
+	matches, err := Find(context.Background(), imgsrc, subsrc, Options{
+		K:      3,
+		ROI:    roi,
+		Refine: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[0].Bounds != rect {
+		t.Errorf("expected %v got %v", rect, matches[0].Bounds)
+	}
+	for _, m := range matches {
+		if !m.Bounds.In(roi) {
+			t.Errorf("match %v outside of %v", m.Bounds, roi)
+		}
+	}
+
+	// A region that does not contain the subimage only has worse matches
+	roi = image.Rect(0, 200, 250, 418)
+	matches, err = Find(context.Background(), imgsrc, subsrc, Options{
+		K:      3,
+		ROI:    roi,
+		Refine: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		if !m.Bounds.In(roi) {
+			t.Errorf("match %v outside of %v", m.Bounds, roi)
+		}
+		if m.Bounds == rect || m.Match > 0.99 {
+			t.Errorf("expected a worse match than %v, got %v %f", rect, m.Bounds, m.Match)
+		}
+	}
+
+	_, err = Find(context.Background(), imgsrc, subsrc, Options{ROI: image.Rect(1000, 0, 1100, 100)})
+	if !errors.Is(err, ErrInvalidROI) {
+		t.Errorf("expected ErrInvalidROI, got %v", err)
+	}
+}
+
+func TestFindImageOrigin(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := toRGBA(imgsrc)
+	rect := image.Rect(271, 109, 371, 207)
+
+	// A haystack shifted to a negative origin
+	shifted := image.NewRGBA(rgba.Bounds().Add(image.Pt(-300, -200)))
+	draw.Draw(shifted, shifted.Bounds(), rgba, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name     string
+		haystack image.Image
+		needle   image.Image
+		expected image.Rectangle
+	}{
+		{
+			name:     "subimage",
+			haystack: rgba.SubImage(image.Rect(150, 60, 480, 300)),
+			needle:   rgba.SubImage(rect),
+			expected: rect,
+		},
+		{
+			name:     "negative",
+			haystack: shifted,
+			needle:   rgba.SubImage(rect),
+			expected: rect.Add(image.Pt(-300, -200)),
+		},
+	}
+
+	for _, test := range tests {
+		for _, backend := range []Backend{BackendDirect, BackendFFT} {
+			for _, refine := range []bool{false, true} {
+				matches, err := Find(context.Background(), test.haystack, test.needle, Options{
+					K:       1,
+					Backend: backend,
+					Refine:  refine,
+					HTML:    io.Discard,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				m := matches[0]
+				if refine {
+					if m.Bounds != test.expected {
+						t.Errorf("%s %s refined: expected %v got %v", test.name, backend, test.expected, m.Bounds)
+					}
+					continue
+				}
+				// Unrefined matches are only as precise as the downscaled
+				// haystack
+				if d := m.Bounds.Min.Sub(test.expected.Min); math.Abs(float64(d.X)) > 10 || math.Abs(float64(d.Y)) > 10 {
+					t.Errorf("%s %s: expected %v got %v", test.name, backend, test.expected, m.Bounds)
+				}
+			}
+		}
+	}
+}
+
+func TestFindSwap(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+
+	_, err = Find(context.Background(), subsrc, imgsrc, Options{})
+	if !errors.Is(err, ErrNeedleTooLarge) {
+		t.Fatalf("expected ErrNeedleTooLarge, got %v", err)
+	}
+
+	matches, err := Find(context.Background(), subsrc, imgsrc, Options{
+		K:      1,
+		Swap:   true,
+		Refine: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matches[0]; !m.Swapped || m.Bounds != rect {
+		t.Errorf("expected swapped %v, got %v swapped %v", rect, m.Bounds, m.Swapped)
+	}
+
+	results, err := FindMany(context.Background(), subsrc, []Needle{{Name: "haystack", Image: imgsrc}}, Options{
+		K:    1,
+		Swap: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Err != nil || len(r.Matches) != 1 || !r.Matches[0].Swapped {
+		t.Errorf("expected a swapped match, got %v %v", r.Matches, r.Err)
+	}
+}
+
+func TestFindFrames(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := image.Rect(271, 109, 371, 207)
+	subsrc := createSubImage(imgsrc, rect)
+	blank := image.NewRGBA(imgsrc.Bounds())
+
+	matches, err := FindFrames(context.Background(), []image.Image{blank, imgsrc, blank}, subsrc, Options{
+		K:      2,
+		Refine: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if m := matches[0]; m.Frame != 1 || m.Bounds != rect {
+		t.Errorf("expected %v in frame 1, got %v in frame %d", rect, m.Bounds, m.Frame)
+	}
+
+	_, err = FindFrames(context.Background(), []image.Image{blank}, subsrc, Options{Threshold: 0.99})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Errorf("expected ErrNoMatches, got %v", err)
+	}
+}
+
+type quadraticScorer struct {
+	x, y float64
+}
+
+func (s quadraticScorer) score(img *image.RGBA, x int, y int) float64 {
+	dx := float64(x) - s.x
+	dy := float64(y) - s.y
+	return 1 - dx*dx - 0.5*dy*dy - 0.2*dx*dy
+}
+
+func TestAnnotate(t *testing.T) {
+	gray := color.RGBA{128, 128, 128, 255}
+	img := image.NewRGBA(image.Rect(10, 20, 210, 120))
+	draw.Draw(img, img.Bounds(), &image.Uniform{gray}, image.Point{}, draw.Src)
+	matches := []Match{
+		{Bounds: image.Rect(60, 60, 100, 100), Match: 1},
+	}
+
+	annotated := Annotate(img, matches)
+	if annotated.Bounds() != img.Bounds() {
+		t.Fatalf("expected bounds %v, got %v", img.Bounds(), annotated.Bounds())
+	}
+	if c := annotated.RGBAAt(80, 100); c != matchColor(1) {
+		t.Errorf("expected outline %v, got %v", matchColor(1), c)
+	}
+	if c := annotated.RGBAAt(80, 80); c != gray {
+		t.Errorf("expected unchanged inside of match, got %v", c)
+	}
+	if c := annotated.RGBAAt(62, 50); c == gray {
+		t.Errorf("expected label above match")
+	}
+	if img.RGBAAt(80, 100) != gray {
+		t.Errorf("expected source image to be unchanged")
+	}
+}
+
+func TestSubpixelOffset(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	subimg := image.NewRGBA(image.Rect(0, 0, 5, 5))
+
+	peak := quadraticScorer{x: 10.3, y: 7.8}
+	ox, oy, ok := subpixelOffset(img, peak, subimg, image.Point{10, 8})
+	if !ok || math.Abs(10+ox-peak.x) > 1e-9 || math.Abs(8+oy-peak.y) > 1e-9 {
+		t.Errorf("expected peak at %f,%f got %f,%f (ok %v)", peak.x, peak.y, 10+ox, 8+oy, ok)
+	}
+
+	// Neighborhood outside of the image
+	ox, oy, ok = subpixelOffset(img, peak, subimg, image.Point{0, 8})
+	if ok || ox != 0 || oy != 0 {
+		t.Errorf("expected no offset at the edge, got %f,%f (ok %v)", ox, oy, ok)
+	}
+
+	// Peak more than a pixel away
+	ox, oy, ok = subpixelOffset(img, peak, subimg, image.Point{8, 8})
+	if ok || ox != 0 || oy != 0 {
+		t.Errorf("expected no offset far from the peak, got %f,%f (ok %v)", ox, oy, ok)
+	}
+
+	// No maximum
+	ox, oy, ok = subpixelFit([3][3]float64{{1, 0, 1}, {0, 0, 0}, {1, 0, 1}})
+	if ok || ox != 0 || oy != 0 {
+		t.Errorf("expected no offset without a maximum, got %f,%f (ok %v)", ox, oy, ok)
+	}
+}
+
+func TestFindSubpixel(t *testing.T) {
+	img, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subimg, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Found on a downscaled haystack, the position is not reported
+	matches, err := Find(context.Background(), img, subimg, Options{K: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches[0].Subpixel {
+		t.Errorf("expected no sub-pixel position, got %f,%f", matches[0].X, matches[0].Y)
+	}
+	data, err := json.Marshal(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "subpixel") {
+		t.Errorf("expected no subpixel in %s", data)
+	}
+
+	// Refined at the original resolution, it is within a pixel of the bounds
+	matches, err = Find(context.Background(), img, subimg, Options{K: 1, Refine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := matches[0]
+	if !m.Subpixel {
+		t.Fatal("expected a sub-pixel position")
+	}
+	if math.Abs(m.X-float64(m.Bounds.Min.X)) > 1 || math.Abs(m.Y-float64(m.Bounds.Min.Y)) > 1 {
+		t.Errorf("expected sub-pixel position near %v, got %f,%f", m.Bounds.Min, m.X, m.Y)
+	}
+	data, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "subpixel") {
+		t.Errorf("expected subpixel in %s", data)
+	}
+
+	// At the corner of the haystack the fit is rejected, so there is none
+	corner := image.Rect(0, 0, 100, 98)
+	matches, err = Find(context.Background(), img, createSubImage(img, corner), Options{K: 1, Refine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matches[0]; m.Bounds != corner || m.Subpixel {
+		t.Errorf("expected %v without sub-pixel position, got %v at %f,%f", corner, m.Bounds, m.X, m.Y)
+	}
+}
+
+func TestSelectScoresNMS(t *testing.T) {
+	inner := image.Rect(0, 0, 60, 5)
+	size := image.Pt(10, 10)
+	scoreMap := func(scores map[image.Point]float64) []float64 {
+		m := make([]float64, inner.Dx()*inner.Dy())
+		for i := range m {
+			m[i] = math.NaN()
+		}
+		for p, v := range scores {
+			m[p.Y*inner.Dx()+p.X] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		sel      selection
+		scores   map[image.Point]float64
+		expected []image.Point
+	}{
+		{
+			name: "iou",
+			sel:  selection{k: 3, threshold: noThreshold, nms: nms{iou: 0.3}},
+			scores: map[image.Point]float64{
+				{0, 0}:  0.5,
+				{1, 0}:  0.9, // suppresses 0,0
+				{2, 0}:  0.8, // suppressed by 1,0
+				{50, 0}: 0.7, // distinct
+				{20, 0}: 0.6, // distinct
+				{30, 0}: 0.4, // distinct but worse than all of the above
+				{51, 1}: 0.8, // suppresses 50,0
+			},
+			expected: []image.Point{{1, 0}, {51, 1}, {20, 0}},
+		},
+		{
+			// A match that suppresses several better ones than the last
+			// one kept, which is only selected once they are suppressed
+			name: "backfill",
+			sel:  selection{k: 2, threshold: noThreshold, nms: nms{dist: 8}},
+			scores: map[image.Point]float64{
+				{0, 0}:  0.8,
+				{10, 0}: 0.7,
+				{30, 0}: 0.5,
+				{5, 1}:  0.9, // suppresses 0,0 and 10,0
+			},
+			expected: []image.Point{{5, 1}, {30, 0}},
+		},
+		{
+			name: "threshold",
+			sel:  selection{threshold: 0.6, nms: nms{disjoint: true}},
+			scores: map[image.Point]float64{
+				{0, 0}:  0.9,
+				{5, 0}:  0.8, // overlaps 0,0
+				{20, 0}: 0.7,
+				{40, 0}: 0.5, // below the threshold
+			},
+			expected: []image.Point{{0, 0}, {20, 0}},
+		},
+	}
+	for _, test := range tests {
+		matches := selectScores(scoreMap(test.scores), inner, size, test.sel)
+		if len(matches) != len(test.expected) {
+			t.Errorf("%s: expected %d matches, got %v", test.name, len(test.expected), matches)
+			continue
+		}
+		for i, p := range test.expected {
+			if matches[i].Bounds.Min != p {
+				t.Errorf("%s: match %d: expected %v got %v", test.name, i, p, matches[i].Bounds.Min)
+			}
+		}
+	}
+}
+
+// TestSelectScoredBounded compares selecting from bounded lists of the best
+// positions of parts of random score maps, like the workers of the direct
+// backend keep, to applying the selection to a match at every position.
+func TestSelectScoredBounded(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	selections := []selection{
+		{k: 1, threshold: noThreshold},
+		{k: 4, threshold: noThreshold, nms: nms{disjoint: true}},
+		{k: 3, threshold: noThreshold, nms: nms{iou: 0.3}},
+		{k: 5, threshold: noThreshold, nms: nms{dist: 2.5}},
+		{threshold: 0.5, nms: nms{disjoint: true}},
+	}
+	for n := 0; n < 200; n++ {
+		inner := image.Rect(2, 3, 2+1+rng.Intn(30), 3+1+rng.Intn(30))
+		size := image.Pt(1+rng.Intn(6), 1+rng.Intn(6))
+		w := inner.Dx()
+
+		// Few distinct scores, so that ties are broken by position
+		scores := make([]float64, w*inner.Dy())
+		var all Matches
+		for i := range scores {
+			scores[i] = float64(rng.Intn(20)) / 20
+			p := image.Pt(inner.Min.X+i%w, inner.Min.Y+i/w)
+			all = append(all, Match{Bounds: image.Rectangle{p, p.Add(size)}, Match: scores[i]})
+		}
+
+		for _, sel := range selections {
+			expected := sel.apply(append(Matches(nil), all...))
+
+			tops := make([]*topScores, 1+rng.Intn(4))
+			for i := range tops {
+				tops[i] = newTopScores(sel.visits(size), sel.threshold)
+			}
+			for i, v := range scores {
+				tops[i*len(tops)/len(scores)].push(i, v)
+			}
+			lists := make([][]scored, len(tops))
+			for i, top := range tops {
+				lists[i] = top.items
+			}
+
+			matches := selectScored(lists, inner, size, sel)
+			if len(matches) != len(expected) {
+				t.Fatalf("%+v: expected %d matches, got %d", sel, len(expected), len(matches))
+			}
+			for i := range expected {
+				if !reflect.DeepEqual(matches[i], expected[i]) {
+					t.Fatalf("%+v: match %d: expected %v got %v", sel, i, expected[i], matches[i])
+				}
+			}
+		}
+	}
+}
+
+func TestFindImageNMSCount(t *testing.T) {
+	// Copies of a noise patch at distinct positions on a noise background
+	rnd := rand.New(rand.NewSource(0))
+	noise := func(w, h int) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(rnd.Intn(256))
+			if i%4 == 3 {
+				img.Pix[i] = 255
+			}
+		}
+		return img
+	}
+	img := noise(256, 192)
+	patch := noise(32, 32)
+
+	// Two partial copies that do not suppress each other, but are both
+	// suppressed by the copy at 150,158 found after them
+	for _, p := range []image.Point{{134, 142}, {166, 142}} {
+		draw.Draw(img, patch.Bounds().Add(p), patch, image.Point{}, draw.Src)
+	}
+	positions := []image.Point{{10, 10}, {100, 20}, {222, 78}, {150, 158}}
+	for _, p := range positions {
+		draw.Draw(img, patch.Bounds().Add(p), patch, image.Point{}, draw.Src)
+	}
+
+	// The copies are the best matches, followed by distinct positions in
+	// the background
+	k := len(positions) + 6
+	for _, backend := range []Backend{BackendDirect, BackendFFT} {
+		for _, opts := range []Options{
+			{K: k, NMSIoU: 0.1, Backend: backend},
+			{K: k, NMSDistance: 30, Backend: backend},
+		} {
+			matches, err := Find(context.Background(), img, patch, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != k {
+				t.Errorf("%s: expected %d matches, got %d", backend, k, len(matches))
+				continue
+			}
+			for _, p := range positions {
+				found := false
+				for _, m := range matches[:len(positions)] {
+					found = found || m.Bounds.Min == p
+				}
+				if !found {
+					t.Errorf("%s: expected a top match at %v, got %v", backend, p, matches)
+				}
+			}
+		}
+	}
+}
+
+func TestFindImageNMS(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsrc, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dist := 50.
+	matches, err := Find(context.Background(), imgsrc, subsrc, Options{NMSDistance: dist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != DefaultOptions.K {
+		t.Fatalf("expected %d matches, got %d", DefaultOptions.K, len(matches))
+	}
+	for i := range matches {
+		for j := i + 1; j < len(matches); j++ {
+			a := matches[i].Bounds.Min
+			b := matches[j].Bounds.Min
+			dx := float64(a.X - b.X)
+			dy := float64(a.Y - b.Y)
+			// Allow for rounding when scaling back to original pixels
+			if math.Sqrt(dx*dx+dy*dy) < dist-8 {
+				t.Errorf("matches %v and %v are too close", a, b)
+			}
+		}
+	}
+}
+
+func TestFindImageThreshold(t *testing.T) {
+	// Tile the same pattern at known positions on a noisy background
+	rnd := rand.New(rand.NewSource(0))
+	imgsrc := image.NewRGBA(image.Rect(0, 0, 240, 160))
+	for i := range imgsrc.Pix {
+		imgsrc.Pix[i] = uint8(rnd.Intn(256))
+	}
+	subsrc := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for i := range subsrc.Pix {
+		subsrc.Pix[i] = uint8(rnd.Intn(256))
+	}
+	// Keep the subimage opaque
+	for i := 3; i < len(subsrc.Pix); i += 4 {
+		subsrc.Pix[i] = 255
+	}
+
+	positions := []image.Point{{10, 10}, {100, 20}, {180, 100}, {40, 120}, {150, 60}}
+	for _, p := range positions {
+		r := subsrc.Bounds().Add(p)
+		draw.Draw(imgsrc, r, subsrc, image.Point{}, draw.Src)
+	}
+
+	for _, backend := range []Backend{BackendDirect, BackendFFT} {
+		matches, err := Find(context.Background(), imgsrc, subsrc, Options{
+			Threshold:     0.95,
+			ImageMinWidth: 240,
+			Backend:       backend,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(matches) != len(positions) {
+			t.Fatalf("%s: expected %d matches, got %d", backend, len(positions), len(matches))
+		}
+
+		found := map[image.Point]bool{}
+		for _, m := range matches {
+			found[m.Bounds.Min] = true
+		}
+		for _, p := range positions {
+			if !found[p] {
+				t.Errorf("%s: expected match at %v", backend, p)
+			}
+		}
+	}
+}
+
+func TestTransparentSubimage(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := resizeImage(imgsrc, 128, 0)
+	rect := image.Rect(40, 30, 60, 46)
+	subimg := toRGBA(createSubImage(img, rect))
+
+	// Make a checkerboard of the subimage fully transparent and the rest
+	// partially transparent
+	b := subimg.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := subimg.RGBAAt(x, y)
+			if (x/4+y/4)%2 == 0 {
+				subimg.SetRGBA(x, y, color.RGBA{})
+			} else {
+				subimg.Set(x, y, color.NRGBA{c.R, c.G, c.B, 200})
+			}
+		}
+	}
+
+	for _, metric := range []Metric{MetricSAD, MetricSSD, MetricZNCC} {
+		direct, _ := convolutionTopKParallel(context.Background(), img, subimg, metric, selection{k: 1})
+		fft, _ := convolutionTopKFFT(context.Background(), newFFTImage(img), subimg, metric, selection{k: 1})
+		for _, matches := range []Matches{direct, fft} {
+			if matches[0].Bounds != rect {
+				t.Errorf("%s: expected top match at %s, got %s", metric, rect, matches[0].Bounds)
+			}
+			if matches[0].Match < 0.99 {
+				t.Errorf("%s: expected match above 0.99, got %f", metric, matches[0].Match)
+			}
+		}
+	}
+}
+
+func TestApplyMask(t *testing.T) {
+	subimg := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(subimg, subimg.Bounds(), image.NewUniform(color.RGBA{200, 100, 50, 255}), image.Point{}, draw.Src)
+
+	// Left half black, right half white
+	mask := image.NewGray(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 2; x < 4; x++ {
+			mask.SetGray(x, y, color.Gray{255})
+		}
+	}
+
+	masked := ApplyMask(subimg, mask)
+	if a := masked.RGBAAt(0, 4).A; a != 0 {
+		t.Errorf("expected transparent pixel on the left, got alpha %d", a)
+	}
+	if c := masked.RGBAAt(7, 4); c != (color.RGBA{200, 100, 50, 255}) {
+		t.Errorf("expected opaque pixel on the right, got %v", c)
+	}
+}
+
+func TestFindErrors(t *testing.T) {
+	small := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	large := image.NewRGBA(image.Rect(0, 0, 60, 30))
+
+	_, err := Find(context.Background(), small, large, Options{})
+	if !errors.Is(err, ErrNeedleTooLarge) {
+		t.Fatalf("expected ErrNeedleTooLarge, got %v", err)
+	}
+	var sizeErr *SizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("expected *SizeError, got %T", err)
+	}
+	if sizeErr.Needle != image.Pt(60, 30) || sizeErr.Haystack != image.Pt(50, 40) {
+		t.Errorf("unexpected sizes in %v", sizeErr)
+	}
+
+	// Fits into the haystack, but not at any of the downscaled widths
+	wide := image.NewRGBA(image.Rect(0, 0, 1000, 100))
+	_, err = Find(context.Background(), wide, image.NewRGBA(image.Rect(0, 0, 999, 10)), Options{})
+	if !errors.As(err, &sizeErr) {
+		t.Errorf("expected *SizeError, got %v", err)
+	}
+
+	// Solid images match everywhere equally well, but not above 1
+	needle := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	_, err = Find(context.Background(), small, needle, Options{Threshold: 1.5})
+	if !errors.Is(err, ErrNoMatches) {
+		t.Fatalf("expected ErrNoMatches, got %v", err)
+	}
+
+	_, err = Find(context.Background(), small, needle, Options{Metric: "foo"})
+	if !errors.Is(err, ErrInvalidMetric) {
+		t.Errorf("expected ErrInvalidMetric, got %v", err)
+	}
+	_, err = Find(context.Background(), small, needle, Options{Backend: "bar"})
+	if !errors.Is(err, ErrInvalidBackend) {
+		t.Errorf("expected ErrInvalidBackend, got %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestFindHTMLError(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsrc, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Find(context.Background(), imgsrc, subsrc, Options{HTML: failingWriter{}})
+	if err == nil {
+		t.Fatal("expected an error writing HTML")
+	}
+}
+
+func TestFindCancelled(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsrc, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = Find(ctx, imgsrc, subsrc, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// Cancelled during a search over many widths and scales, once the first
+	// width is done, its best matches are returned
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := Options{
+		K:             3,
+		ScaleMin:      0.5,
+		ScaleMax:      2,
+		ImageMinWidth: 128,
+		ImageMaxWidth: 1024,
+		HTML:          cancelWriter{cancel},
+	}
+	matches, err := Find(ctx, imgsrc, subsrc, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(matches) != opts.K {
+		t.Fatalf("expected %d partial matches, got %d", opts.K, len(matches))
+	}
+	for i, m := range matches {
+		if !m.Bounds.In(imgsrc.Bounds()) {
+			t.Errorf("match %d: %v outside of the haystack", i, m.Bounds)
+		}
+		if i > 0 && m.Match > matches[i-1].Match {
+			t.Errorf("match %d: expected matches sorted by score, got %f after %f", i, m.Match, matches[i-1].Match)
+		}
+	}
+}
+
+// cancelWriter calls cancel when the HTML of a search run is written to it,
+// which is after the run has found its matches.
+type cancelWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("<h2>")) {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestFindMany(t *testing.T) {
+	imgsrc, err := openImage("../assets/haystack.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsrc, err := openImage("../assets/needle.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := image.NewRGBA(image.Rect(0, 0, imgsrc.Bounds().Dx()+1, 10))
+
+	opts := Options{K: 3}
+	results, err := FindMany(context.Background(), imgsrc, []Needle{
+		{Name: "needle", Image: subsrc},
+		{Name: "large", Image: large},
+		{Name: "again", Image: subsrc},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	expected, err := Find(context.Background(), imgsrc, subsrc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		r := results[i]
+		if r.Err != nil {
+			t.Errorf("%s: unexpected error %v", r.Name, r.Err)
+		}
+		if !reflect.DeepEqual(r.Matches, expected) {
+			t.Errorf("%s: expected %v, got %v", r.Name, expected, r.Matches)
+		}
+	}
+	if !errors.Is(results[1].Err, ErrNeedleTooLarge) {
+		t.Errorf("expected ErrNeedleTooLarge, got %v", results[1].Err)
+	}
+}
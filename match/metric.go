@@ -0,0 +1,143 @@
+package match
+
+import (
+	"image"
+	"math"
+)
+
+// scorer scores the subimage it was created for at a position in an image.
+type scorer interface {
+	score(img *image.RGBA, x int, y int) float64
+}
+
+func newScorer(metric Metric, subimg *image.RGBA) scorer {
+	if !subimg.Opaque() {
+		return newMaskedScorer(metric, subimg)
+	}
+	b := subimg.Bounds()
+	n := float64(b.Dx() * b.Dy() * 3)
+	switch metric {
+	case MetricSSD:
+		return ssdScorer{subimg: subimg, norm: 1 / (n * 0xFF * 0xFF)}
+	case MetricZNCC:
+		return newZNCCScorer(subimg)
+	default:
+		return sadScorer{subimg: subimg, norm: 1 / (n * 0xFF)}
+	}
+}
+
+type sadScorer struct {
+	subimg *image.RGBA
+	norm   float64
+}
+
+func (s sadScorer) score(img *image.RGBA, x int, y int) float64 {
+	return 1 - float64(sumOfAbsDiffRGBA(img, x, y, s.subimg))*s.norm
+}
+
+type ssdScorer struct {
+	subimg *image.RGBA
+	norm   float64
+}
+
+func (s ssdScorer) score(img *image.RGBA, x int, y int) float64 {
+	return 1 - float64(sumOfSquaredDiffRGBA(img, x, y, s.subimg))*s.norm
+}
+
+type znccScorer struct {
+	subimg *image.RGBA
+	// Per-channel mean of the subimage
+	mean [3]float64
+	// Sum of squared deviations from the mean over all channels
+	dev float64
+}
+
+func newZNCCScorer(subimg *image.RGBA) znccScorer {
+	s := znccScorer{subimg: subimg}
+	b := subimg.Bounds()
+	n := float64(b.Dx() * b.Dy())
+
+	var sum, sum2 [3]float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := subimg.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				v := float64(subimg.Pix[i+c])
+				sum[c] += v
+				sum2[c] += v * v
+			}
+		}
+	}
+
+	for c := 0; c < 3; c++ {
+		s.mean[c] = sum[c] / n
+		s.dev += sum2[c] - sum[c]*sum[c]/n
+	}
+	return s
+}
+
+func (s znccScorer) score(img *image.RGBA, x int, y int) float64 {
+	b := s.subimg.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+	n := float64(w * h)
+
+	ipix := img.Pix
+	spix := s.subimg.Pix
+
+	var isum, isum2, cross [3]float64
+	for ny := 0; ny < h; ny++ {
+		for nx := 0; nx < w; nx++ {
+			i := img.PixOffset(x+nx, y+ny)
+			j := s.subimg.PixOffset(b.Min.X+nx, b.Min.Y+ny)
+			for c := 0; c < 3; c++ {
+				v := float64(ipix[i+c])
+				isum[c] += v
+				isum2[c] += v * v
+				cross[c] += v * (float64(spix[j+c]) - s.mean[c])
+			}
+		}
+	}
+
+	num := 0.
+	dev := 0.
+	for c := 0; c < 3; c++ {
+		num += cross[c]
+		dev += isum2[c] - isum[c]*isum[c]/n
+	}
+	return zncc(num, dev, s.dev)
+}
+
+// zncc returns the normalized cross-correlation given the zero-mean
+// cross-correlation and the sums of squared deviations of both images.
+// Flat regions without any variance do not correlate with anything.
+func zncc(num float64, deva float64, devb float64) float64 {
+	den := math.Sqrt(deva * devb)
+	if den < 1e-9 {
+		return 0
+	}
+	v := num / den
+	return math.Max(-1, math.Min(1, v))
+}
+
+func sumOfSquaredDiffRGBA(img *image.RGBA, x int, y int, subimg *image.RGBA) uint64 {
+	sum := uint64(0)
+	b := subimg.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+
+	ipix := img.Pix
+	spix := subimg.Pix
+
+	for ny := 0; ny < h; ny++ {
+		for nx := 0; nx < w; nx++ {
+			i := img.PixOffset(x+nx, y+ny)
+			j := subimg.PixOffset(b.Min.X+nx, b.Min.Y+ny)
+			for c := 0; c < 3; c++ {
+				d := int64(ipix[i+c]) - int64(spix[j+c])
+				sum += uint64(d * d)
+			}
+		}
+	}
+	return sum
+}
@@ -0,0 +1,266 @@
+package match
+
+import (
+	"container/heap"
+	"image"
+	"math"
+	"sort"
+)
+
+// nms configures non-maximum suppression, a match is suppressed if a better
+// one overlaps it by more than iou (intersection over union) or its top-left
+// corner is closer than dist pixels. Zero values disable the respective check.
+// If disjoint is set, any overlap suppresses the worse match.
+type nms struct {
+	iou      float64
+	dist     float64
+	disjoint bool
+}
+
+func (n nms) enabled() bool {
+	return n.iou > 0 || n.dist > 0 || n.disjoint
+}
+
+// suppresses returns true if matches with bounds a and b cannot both be kept.
+func (n nms) suppresses(a image.Rectangle, b image.Rectangle) bool {
+	if n.disjoint && a.Overlaps(b) {
+		return true
+	}
+	if n.iou > 0 && iou(a, b) > n.iou {
+		return true
+	}
+	if n.dist > 0 {
+		dx := float64(a.Min.X - b.Min.X)
+		dy := float64(a.Min.Y - b.Min.Y)
+		if math.Sqrt(dx*dx+dy*dy) < n.dist {
+			return true
+		}
+	}
+	return false
+}
+
+// iou returns the intersection over union of two rectangles.
+func iou(a image.Rectangle, b image.Rectangle) float64 {
+	itr := a.Intersect(b)
+	if itr.Empty() {
+		return 0
+	}
+	ia := itr.Dx() * itr.Dy()
+	ua := a.Dx()*a.Dy() + b.Dx()*b.Dy() - ia
+	return float64(ia) / float64(ua)
+}
+
+// suppress returns matches without the ones suppressed by a better match,
+// sorted by score.
+func (n nms) suppress(matches Matches) Matches {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Match > matches[j].Match
+	})
+	if !n.enabled() {
+		return matches
+	}
+	kept := matches[:0]
+	for _, m := range matches {
+		suppressed := false
+		for _, o := range kept {
+			if n.suppresses(o.Bounds, m.Bounds) {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// noThreshold is the selection threshold that keeps matches of any score,
+// which can be negative with MetricZNCC.
+var noThreshold = math.Inf(-1)
+
+// selection configures which matches are kept. Matches scoring below
+// threshold are dropped, and only the best k are kept unless k is zero.
+type selection struct {
+	k         int
+	threshold float64
+	nms       nms
+}
+
+// apply returns the selected matches sorted by score.
+func (s selection) apply(matches Matches) Matches {
+	matches = s.nms.suppress(matches)
+	for i, m := range matches {
+		if m.Match < s.threshold {
+			matches = matches[:i]
+			break
+		}
+	}
+	if s.k > 0 && len(matches) > s.k {
+		matches = matches[:s.k]
+	}
+	return matches
+}
+
+// visits returns how many of the best positions of a score map of subimages
+// of size have to be visited at most to select sel, or zero if all of them
+// might have to. Each kept match suppresses at most the positions in its
+// neighborhood, so the k matches are kept among the best k times the
+// neighborhood positions.
+func (s selection) visits(size image.Point) int {
+	if s.k <= 0 {
+		return 0
+	}
+	n := 1
+	if s.nms.disjoint || s.nms.iou > 0 {
+		// Positions overlapping it
+		n += (2*size.X - 1) * (2*size.Y - 1)
+	}
+	if s.nms.dist > 0 {
+		d := int(math.Ceil(s.nms.dist))
+		n += (2*d + 1) * (2*d + 1)
+	}
+	return s.k * n
+}
+
+// selectScores returns the matches selected by sel out of a score map, the
+// scores of a subimage of size at every position of inner in row-major order.
+// NaN scores are of positions that were not scored and are skipped.
+func selectScores(scores []float64, inner image.Rectangle, size image.Point, sel selection) Matches {
+	top := newTopScores(sel.visits(size), sel.threshold)
+	for i, v := range scores {
+		top.push(i, v)
+	}
+	return selectScored([][]scored{top.items}, inner, size, sel)
+}
+
+// selectScored returns the matches selected by sel out of lists of scored
+// positions of inner, e.g. the ones kept by several topScores.
+//
+// The positions are visited from the best score down, merging the lists,
+// and each one is kept unless a kept one suppresses it, so that the result
+// is the same as applying sel to a match at every position, without creating
+// all of them.
+func selectScored(lists [][]scored, inner image.Rectangle, size image.Point, sel selection) Matches {
+	var h mergeHeap
+	for _, l := range lists {
+		sort.Slice(l, func(i, j int) bool {
+			return l[i].better(l[j])
+		})
+		if len(l) > 0 {
+			h = append(h, l)
+		}
+	}
+	heap.Init(&h)
+
+	w := inner.Dx()
+	var matches Matches
+	for h.Len() > 0 && (sel.k <= 0 || len(matches) < sel.k) {
+		s := h[0][0]
+		if len(h[0]) > 1 {
+			h[0] = h[0][1:]
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+
+		p := image.Pt(inner.Min.X+s.i%w, inner.Min.Y+s.i/w)
+		bounds := image.Rectangle{p, p.Add(size)}
+		suppressed := false
+		if sel.nms.enabled() {
+			for _, o := range matches {
+				if sel.nms.suppresses(o.Bounds, bounds) {
+					suppressed = true
+					break
+				}
+			}
+		}
+		if !suppressed {
+			matches = append(matches, Match{Bounds: bounds, Match: s.v})
+		}
+	}
+	return matches
+}
+
+// scored is the score v of the position at index i of a score map.
+type scored struct {
+	i int
+	v float64
+}
+
+// better returns whether s is visited before o, by score and then by index
+// like a row-major scan.
+func (s scored) better(o scored) bool {
+	if s.v != o.v {
+		return s.v > o.v
+	}
+	return s.i < o.i
+}
+
+// topScores keeps the best n scored positions pushed to it that are not
+// below threshold, or all of them if n is zero. The kept ones are a min-heap,
+// so that the worst one is replaced first.
+type topScores struct {
+	n         int
+	threshold float64
+	items     []scored
+}
+
+func newTopScores(n int, threshold float64) *topScores {
+	return &topScores{
+		n:         n,
+		threshold: threshold,
+	}
+}
+
+// push adds the score v of the position at index i, unless it is NaN.
+func (t *topScores) push(i int, v float64) {
+	if math.IsNaN(v) || v < t.threshold {
+		return
+	}
+	s := scored{i: i, v: v}
+	switch {
+	case t.n == 0:
+		t.items = append(t.items, s)
+	case len(t.items) < t.n:
+		heap.Push(t, s)
+	case s.better(t.items[0]):
+		t.items[0] = s
+		heap.Fix(t, 0)
+	}
+}
+
+func (t *topScores) Len() int { return len(t.items) }
+
+func (t *topScores) Less(i, j int) bool { return t.items[j].better(t.items[i]) }
+
+func (t *topScores) Swap(i, j int) { t.items[i], t.items[j] = t.items[j], t.items[i] }
+
+func (t *topScores) Push(x any) { t.items = append(t.items, x.(scored)) }
+
+func (t *topScores) Pop() any {
+	n := len(t.items) - 1
+	s := t.items[n]
+	t.items = t.items[:n]
+	return s
+}
+
+// mergeHeap is a heap of sorted lists of scored positions, ordered by their
+// first one.
+type mergeHeap [][]scored
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool { return h[i][0].better(h[j][0]) }
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.([]scored)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old) - 1
+	l := old[n]
+	*h = old[:n]
+	return l
+}
@@ -0,0 +1,61 @@
+package match
+
+import "image"
+
+// Orientation is an EXIF orientation, which describes how the pixels of an
+// image are transformed to display it. 1 (or any invalid value) means as is.
+type Orientation int
+
+// Apply returns img transformed as described by the orientation, with the
+// origin at (0, 0).
+func (o Orientation) Apply(img image.Image) image.Image {
+	switch o {
+	case 2:
+		return flipImage(img, FlipH)
+	case 3:
+		return rotateRight(img, 2)
+	case 4:
+		return flipImage(img, FlipV)
+	case 5:
+		return flipImage(rotateRight(img, 1), FlipH)
+	case 6:
+		return rotateRight(img, 1)
+	case 7:
+		return flipImage(rotateRight(img, 1), FlipV)
+	case 8:
+		return rotateRight(img, 3)
+	default:
+		return img
+	}
+}
+
+// Raw returns r in an image of size transformed by Apply in the coordinates
+// of the original image.
+func (o Orientation) Raw(r image.Rectangle, size image.Point) image.Rectangle {
+	w, h := size.X, size.Y
+	if o >= 5 && o <= 8 {
+		w, h = h, w
+	}
+	raw := func(p image.Point) image.Point {
+		switch o {
+		case 2:
+			return image.Pt(w-p.X, p.Y)
+		case 3:
+			return image.Pt(w-p.X, h-p.Y)
+		case 4:
+			return image.Pt(p.X, h-p.Y)
+		case 5:
+			return image.Pt(p.Y, p.X)
+		case 6:
+			return image.Pt(p.Y, h-p.X)
+		case 7:
+			return image.Pt(w-p.Y, h-p.X)
+		case 8:
+			return image.Pt(w-p.Y, p.X)
+		default:
+			return p
+		}
+	}
+	min, max := raw(r.Min), raw(r.Max)
+	return image.Rect(min.X, min.Y, max.X, max.Y)
+}
@@ -0,0 +1,79 @@
+package match
+
+import (
+	"fmt"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// pyramid is the haystack resized to the widths searched. The levels are
+// cached, so that the haystack is only resized once when searching for
+// multiple subimages in it. It is not safe for concurrent use.
+//
+// All the levels have their origin at (0, 0), so the matches found in them
+// are relative to the top-left corner of src.
+type pyramid struct {
+	src    image.Image
+	levels map[int]*image.RGBA
+	rgba   *image.RGBA
+	// Position of the top-left corner of src in the haystack, which is
+	// added to the matches
+	offset image.Point
+	// Last level prepared for the FFT backend
+	fft *fftImage
+}
+
+func newPyramid(src image.Image) *pyramid {
+	return &pyramid{
+		src:    src,
+		levels: make(map[int]*image.RGBA),
+		offset: src.Bounds().Min,
+	}
+}
+
+// newROIPyramid returns the pyramid of the part of haystack within roi, or of
+// all of it if roi is empty.
+func newROIPyramid(haystack image.Image, roi image.Rectangle) (*pyramid, error) {
+	if roi.Empty() {
+		return newPyramid(haystack), nil
+	}
+	r := roi.Intersect(haystack.Bounds())
+	if r.Empty() {
+		return nil, fmt.Errorf("%w: %v not in %v", ErrInvalidROI, roi, haystack.Bounds())
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), haystack, r.Min, draw.Src)
+	pyr := newPyramid(cropped)
+	pyr.offset = r.Min
+	return pyr, nil
+}
+
+// level returns the haystack resized to width, keeping the aspect ratio.
+func (p *pyramid) level(width int) *image.RGBA {
+	img, ok := p.levels[width]
+	if !ok {
+		img = resizeImage(p.src, width, 0)
+		p.levels[width] = img
+	}
+	return img
+}
+
+// fftLevel returns the level of width prepared for the FFT backend. Only the
+// last one is kept, as the spectra are large and the levels are searched in
+// order.
+func (p *pyramid) fftLevel(width int) *fftImage {
+	img := p.level(width)
+	if p.fft == nil || p.fft.img != img {
+		p.fft = newFFTImage(img)
+	}
+	return p.fft
+}
+
+// full returns the haystack at its original resolution.
+func (p *pyramid) full() *image.RGBA {
+	if p.rgba == nil {
+		p.rgba = toRGBA(p.src)
+	}
+	return p.rgba
+}
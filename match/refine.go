@@ -0,0 +1,190 @@
+package match
+
+import (
+	"context"
+	"image"
+	"log"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Number of pixels around the predicted position searched at each refinement
+// level. The position is known to within about one pixel of the previous
+// level, which is two pixels at the next one, plus some slack for resampling.
+const refineRadius = 3
+
+// Number of candidates found for every requested match with Refine, so that
+// there are more to refine if some of them converge to the same occurrence.
+const refineCandidates = 4
+
+// refineSelection returns the selection of refined matches. Unless the
+// suppression of overlapping matches is configured, overlapping matches are
+// taken to be the same occurrence, which nearby candidates converge to when
+// refined.
+func (opts Options) refineSelection(scale float64) selection {
+	sel := opts.selection(scale)
+	if !sel.nms.enabled() {
+		sel.nms.disjoint = true
+	}
+	return sel
+}
+
+// refineMatches takes candidate matches found with the haystack resized to
+// coarseWidth and the subimage resized by their SubimageScale, best first, and
+// refines them with refineLevels in order until opts.K distinct matches are
+// selected or the candidates run out, so that candidates that converge to the
+// same occurrence are replaced by the next ones. All the candidates are
+// refined if opts.K is not set.
+//
+// If ctx is cancelled, the matches refined so far are returned along with
+// ctx.Err().
+func refineMatches(ctx context.Context, pyr *pyramid, subsrc image.Image, matches Matches, coarseWidth int, opts Options) (Matches, error) {
+	sel := opts.refineSelection(1)
+
+	var refined Matches
+	next := 0
+	for next < len(matches) {
+		n := len(matches) - next
+		if opts.K > 0 {
+			if len(refined) >= opts.K {
+				break
+			}
+			if need := opts.K - len(refined); n > need {
+				n = need
+			}
+		}
+
+		batch := refineLevels(ctx, pyr, subsrc, matches[next:next+n], coarseWidth, opts)
+		next += n
+		refined = sel.apply(append(refined, batch...))
+
+		if err := ctx.Err(); err != nil {
+			return refined, err
+		}
+	}
+	return refined, nil
+}
+
+// refineLevels re-searches a small window around each of the matches at
+// progressively higher resolutions, doubling the haystack width from
+// coarseWidth until it reaches the original size, and moves each match to the
+// best position of its window. The returned matches have pixel-exact bounds in
+// the original haystack and are scored at the original resolution, unless ctx
+// is cancelled before that.
+func refineLevels(ctx context.Context, pyr *pyramid, subsrc image.Image, matches Matches, coarseWidth int, opts Options) Matches {
+	srcw := pyr.src.Bounds().Dx()
+	subw := float64(subsrc.Bounds().Dx())
+	subh := float64(subsrc.Bounds().Dy())
+
+	// Position estimates in original coordinates
+	est := make([]struct{ x, y float64 }, len(matches))
+	for i, m := range matches {
+		est[i].x = float64(m.Bounds.Min.X)
+		est[i].y = float64(m.Bounds.Min.Y)
+	}
+
+	width := coarseWidth
+	for width < srcw && ctx.Err() == nil {
+		width *= 2
+		if width > srcw {
+			width = srcw
+		}
+
+		var img *image.RGBA
+		if width == srcw {
+			img = pyr.full()
+		} else {
+			img = pyr.level(width)
+		}
+		scale := float64(width) / float64(srcw)
+		imgr := img.Bounds()
+
+		// The subimage resized for every match scale at this level
+		type level struct {
+			subimg *image.RGBA
+			scorer scorer
+		}
+		levels := make(map[float64]*level)
+
+		for i, m := range matches {
+			if ctx.Err() != nil {
+				break
+			}
+
+			sw := int(math.Round(subw * m.SubimageScale * scale))
+			sh := int(math.Round(subh * m.SubimageScale * scale))
+			if sw < 1 || sh < 1 || sw > imgr.Dx() || sh > imgr.Dy() {
+				continue
+			}
+			l, ok := levels[m.SubimageScale]
+			if !ok {
+				l = &level{}
+				if m.SubimageScale == 1 && width == srcw {
+					l.subimg = toRGBA(subsrc)
+				} else {
+					l.subimg = resizeImage(subsrc, sw, sh)
+				}
+				l.scorer = newScorer(opts.Metric, l.subimg)
+				levels[m.SubimageScale] = l
+			}
+			subimg, scorer := l.subimg, l.scorer
+			px := int(math.Round(est[i].x * scale))
+			py := int(math.Round(est[i].y * scale))
+
+			best := math.Inf(-1)
+			bx, by := px, py
+			for y := py - refineRadius; y <= py+refineRadius; y++ {
+				if y < imgr.Min.Y || y+sh > imgr.Max.Y {
+					continue
+				}
+				for x := px - refineRadius; x <= px+refineRadius; x++ {
+					if x < imgr.Min.X || x+sw > imgr.Max.X {
+						continue
+					}
+					score := scorer.score(img, x, y)
+					if score > best {
+						best = score
+						bx, by = x, y
+					}
+				}
+			}
+
+			if math.IsInf(best, -1) {
+				continue
+			}
+
+			est[i].x = float64(bx) / scale
+			est[i].y = float64(by) / scale
+			matches[i].Match = best
+			if width == srcw {
+				ox, oy, ok := subpixelOffset(img, scorer, subimg, image.Point{bx, by})
+				matches[i].Bounds = image.Rect(bx, by, bx+sw, by+sh)
+				matches[i].X = float64(bx) + ox
+				matches[i].Y = float64(by) + oy
+				matches[i].Subpixel = ok
+			} else {
+				matches[i].Bounds = m.Bounds.Sub(m.Bounds.Min).Add(image.Point{
+					X: int(math.Round(est[i].x)),
+					Y: int(math.Round(est[i].y)),
+				})
+				matches[i].X = est[i].x
+				matches[i].Y = est[i].y
+			}
+		}
+
+		if opts.Verbose {
+			log.Printf("refine image size: %dx%d, match: %f %v\n", imgr.Dx(), imgr.Dy(), matches[0].Match, matches[0].Bounds)
+		}
+	}
+
+	return matches
+}
+
+// toRGBA returns img as an *image.RGBA with the origin at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,115 @@
+package match
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// rotateImage returns img rotated clockwise by angle degrees around its
+// center, with the origin at (0, 0). The result is sized to fit the rotated
+// image, the pixels outside of it are transparent, so that they are ignored
+// when matching. Multiples of 90 degrees are rotated exactly.
+func rotateImage(img image.Image, angle float64) *image.RGBA {
+	b := img.Bounds()
+	turns := math.Mod(angle, 360) / 90
+	if turns < 0 {
+		turns += 4
+	}
+	if turns == math.Trunc(turns) {
+		return rotateRight(img, int(turns))
+	}
+
+	size := rotatedSize(b.Size(), angle)
+	rotated := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	scx := float64(b.Min.X) + float64(b.Dx())/2
+	scy := float64(b.Min.Y) + float64(b.Dy())/2
+	dcx := float64(size.X) / 2
+	dcy := float64(size.Y) / 2
+	s2d := f64.Aff3{
+		cos, -sin, dcx - cos*scx + sin*scy,
+		sin, cos, dcy - sin*scx - cos*scy,
+	}
+	draw.CatmullRom.Transform(rotated, s2d, img, b, draw.Src, nil)
+	return rotated
+}
+
+// rotateRight returns img rotated clockwise by turns right angles.
+func rotateRight(img image.Image, turns int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if turns%2 == 1 {
+		w, h = h, w
+	}
+	rotated := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dx, dy := x, y
+			switch turns % 4 {
+			case 1:
+				dx, dy = b.Dy()-1-y, x
+			case 2:
+				dx, dy = b.Dx()-1-x, b.Dy()-1-y
+			case 3:
+				dx, dy = y, b.Dx()-1-x
+			}
+			rotated.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return rotated
+}
+
+// rotatedSize returns the size of the bounding box of a rectangle of size
+// rotated by angle degrees.
+func rotatedSize(size image.Point, angle float64) image.Point {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	sin, cos = math.Abs(sin), math.Abs(cos)
+	w, h := float64(size.X), float64(size.Y)
+	// Avoid growing by a pixel due to rounding errors at right angles
+	const eps = 1e-9
+	return image.Point{
+		X: int(math.Ceil(w*cos + h*sin - eps)),
+		Y: int(math.Ceil(w*sin + h*cos - eps)),
+	}
+}
+
+// polygon returns the corners of a subimage of size rotated by m.Angle and
+// scaled by m.SubimageScale, centered on the match. The corners are in
+// clockwise order starting with the top-left corner of the subimage.
+func polygon(m Match, size image.Point) []Point {
+	sin, cos := math.Sincos(m.Angle * math.Pi / 180)
+	cx := m.X + float64(m.Bounds.Dx())/2
+	cy := m.Y + float64(m.Bounds.Dy())/2
+	hw := float64(size.X) * m.SubimageScale / 2
+	hh := float64(size.Y) * m.SubimageScale / 2
+	corners := []Point{{-hw, -hh}, {hw, -hh}, {hw, hh}, {-hw, hh}}
+	for i, c := range corners {
+		corners[i] = Point{
+			X: cx + c.X*cos - c.Y*sin,
+			Y: cy + c.X*sin + c.Y*cos,
+		}
+	}
+	return corners
+}
+
+// contains returns true if p is inside the convex polygon.
+func contains(polygon []Point, p Point) bool {
+	sign := 0.0
+	for i, a := range polygon {
+		b := polygon[(i+1)%len(polygon)]
+		cross := (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+		if cross == 0 {
+			continue
+		}
+		if sign == 0 {
+			sign = cross
+		} else if (cross > 0) != (sign > 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package match
+
+import (
+	"image"
+	"math"
+)
+
+// subpixelOffset fits a quadratic surface
+//
+//	f(x, y) = a + bx + cy + dx² + exy + fy²
+//
+// to the 3×3 neighborhood of scores around the top-left corner p of a match
+// and returns the offset of its peak from p. If the neighborhood does not fit
+// into the image, the surface has no maximum or it is more than a pixel away,
+// ok is false and the offset is zero.
+func subpixelOffset(img *image.RGBA, s scorer, subimg *image.RGBA, p image.Point) (ox float64, oy float64, ok bool) {
+	imgr := img.Bounds()
+	subimgr := subimg.Bounds()
+	valid := image.Rect(
+		imgr.Min.X,
+		imgr.Min.Y,
+		imgr.Max.X-subimgr.Dx()+1,
+		imgr.Max.Y-subimgr.Dy()+1,
+	)
+	if !image.Rect(p.X-1, p.Y-1, p.X+2, p.Y+2).In(valid) {
+		return 0, 0, false
+	}
+
+	var v [3][3]float64
+	for y := -1; y <= 1; y++ {
+		for x := -1; x <= 1; x++ {
+			v[y+1][x+1] = s.score(img, p.X+x, p.Y+y)
+		}
+	}
+	return subpixelFit(v)
+}
+
+// subpixelFit returns the offset of the peak of the quadratic surface fitted
+// to the 3×3 scores v around a position, see subpixelOffset. If any of the
+// scores is NaN or the fit is rejected, ok is false and the offset is zero.
+func subpixelFit(v [3][3]float64) (ox float64, oy float64, ok bool) {
+	for _, row := range v {
+		for _, val := range row {
+			if math.IsNaN(val) {
+				return 0, 0, false
+			}
+		}
+	}
+
+	// Least squares fit on the 3×3 grid, the terms are orthogonal so each
+	// coefficient can be computed independently.
+	var b, c, d, e, f float64
+	for y := -1; y <= 1; y++ {
+		for x := -1; x <= 1; x++ {
+			fx := float64(x)
+			fy := float64(y)
+			val := v[y+1][x+1]
+			b += fx * val / 6
+			c += fy * val / 6
+			d += (fx*fx - 2./3) * val / 2
+			e += fx * fy * val / 4
+			f += (fy*fy - 2./3) * val / 2
+		}
+	}
+
+	// The peak is where the gradient is zero:
+	//
+	//	[2d  e] [x]    [b]
+	//	[ e 2f] [y] = -[c]
+	det := 4*d*f - e*e
+	if d >= 0 || det <= 0 {
+		// Not a maximum
+		return 0, 0, false
+	}
+	ox = (-2*f*b + e*c) / det
+	oy = (-2*d*c + e*b) / det
+
+	// The integer position is the best one, so the peak should be close to
+	// it, a fit that is more than a pixel away is not reliable.
+	if math.Abs(ox) > 1 || math.Abs(oy) > 1 {
+		return 0, 0, false
+	}
+	return ox, oy, true
+}
+
+// localizeSubpixel sets the sub-pixel position of each match found in img,
+// which is the integer one if the fit is rejected.
+func localizeSubpixel(img *image.RGBA, subimg *image.RGBA, matches Matches, metric Metric) {
+	s := newScorer(metric, subimg)
+	for i := range matches {
+		p := matches[i].Bounds.Min
+		ox, oy, ok := subpixelOffset(img, s, subimg, p)
+		matches[i].X = float64(p.X) + ox
+		matches[i].Y = float64(p.Y) + oy
+		matches[i].Subpixel = ok
+	}
+}
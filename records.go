@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/smilyorg/findimg/match"
+)
+
+// record is a match as printed by the csv and ndjson outputs, one per row or
+// line, with the paths of the images so that the results of several searches
+// can be concatenated.
+type record struct {
+	Image    string     `json:"image"`
+	Subimage string     `json:"subimage"`
+	Rank     int        `json:"rank"`
+	Match    float64    `json:"match"`
+	X        int        `json:"x"`
+	Y        int        `json:"y"`
+	W        int        `json:"w"`
+	H        int        `json:"h"`
+	Raw      *rawBounds `json:"raw,omitempty"`
+	Scale    float64    `json:"scale"`
+	Angle    float64    `json:"angle"`
+	Flip     match.Flip `json:"flip"`
+	Frame    int        `json:"frame"`
+	Swapped  bool       `json:"swapped"`
+	// Time spent searching the image in seconds, shared by all the
+	// subimages searched at once
+	Elapsed float64 `json:"elapsed"`
+}
+
+// rawBounds are the bounds in the raw pixels of the image, see -raw.
+type rawBounds struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// recordOutput returns whether the output is one record per match.
+func recordOutput() bool {
+	return *output == "csv" || *output == "ndjson"
+}
+
+// newRecords returns the records of the matches of subimage in image, ranked
+// in order.
+func newRecords(image, subimage string, matches match.Matches, elapsed time.Duration) []record {
+	records := make([]record, 0, len(matches))
+	for i, m := range matches {
+		r := record{
+			Image:    image,
+			Subimage: subimage,
+			Rank:     i + 1,
+			Match:    m.Match,
+			X:        m.Bounds.Min.X,
+			Y:        m.Bounds.Min.Y,
+			W:        m.Bounds.Dx(),
+			H:        m.Bounds.Dy(),
+			Scale:    m.SubimageScale,
+			Angle:    m.Angle,
+			Flip:     m.Flip,
+			Frame:    m.Frame,
+			Swapped:  m.Swapped,
+			Elapsed:  elapsed.Seconds(),
+		}
+		if r.Flip == "" {
+			r.Flip = match.FlipNone
+		}
+		if !m.RawBounds.Empty() {
+			r.Raw = &rawBounds{
+				X: m.RawBounds.Min.X,
+				Y: m.RawBounds.Min.Y,
+				W: m.RawBounds.Dx(),
+				H: m.RawBounds.Dy(),
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// recordWriter writes records to w as csv rows or ndjson lines, depending on
+// the format, see -o. The csv header is written by the first call to write,
+// so that the records of several searches share it.
+type recordWriter struct {
+	w      io.Writer
+	format string
+	// Whether to include the raw bounds columns in the csv output, see -raw
+	raw bool
+	csv *csv.Writer
+}
+
+func newRecordWriter(w io.Writer, format string, raw bool) *recordWriter {
+	return &recordWriter{w: w, format: format, raw: raw}
+}
+
+// write writes the records as csv rows or ndjson lines.
+func (rw *recordWriter) write(records []record) error {
+	if rw.format == "ndjson" {
+		enc := json.NewEncoder(rw.w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if rw.csv == nil {
+		rw.csv = csv.NewWriter(rw.w)
+		header := []string{"image", "subimage", "rank", "match", "x", "y", "w", "h"}
+		if rw.raw {
+			header = append(header, "raw_x", "raw_y", "raw_w", "raw_h")
+		}
+		header = append(header, "scale", "angle", "flip", "frame", "swapped", "elapsed")
+		rw.csv.Write(header)
+	}
+	for _, r := range records {
+		row := []string{
+			r.Image,
+			r.Subimage,
+			strconv.Itoa(r.Rank),
+			strconv.FormatFloat(r.Match, 'f', 6, 64),
+			strconv.Itoa(r.X),
+			strconv.Itoa(r.Y),
+			strconv.Itoa(r.W),
+			strconv.Itoa(r.H),
+		}
+		if rw.raw {
+			var raw rawBounds
+			if r.Raw != nil {
+				raw = *r.Raw
+			}
+			row = append(row,
+				strconv.Itoa(raw.X),
+				strconv.Itoa(raw.Y),
+				strconv.Itoa(raw.W),
+				strconv.Itoa(raw.H),
+			)
+		}
+		row = append(row,
+			strconv.FormatFloat(r.Scale, 'f', -1, 64),
+			strconv.FormatFloat(r.Angle, 'f', -1, 64),
+			string(r.Flip),
+			strconv.Itoa(r.Frame),
+			strconv.FormatBool(r.Swapped),
+			strconv.FormatFloat(r.Elapsed, 'f', 3, 64),
+		)
+		rw.csv.Write(row)
+	}
+	rw.csv.Flush()
+	return rw.csv.Error()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"image"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smilyorg/findimg/match"
+)
+
+func testRecords(image string) []record {
+	matches := match.Matches{
+		{Bounds: rect(10, 20, 30, 40), Match: 0.9, SubimageScale: 1},
+		{Bounds: rect(50, 60, 30, 40), Match: 0.8, SubimageScale: 1, Flip: match.FlipH},
+	}
+	return newRecords(image, "needle.png", matches, 1500*time.Millisecond)
+}
+
+func rect(x, y, w, h int) image.Rectangle {
+	return image.Rect(x, y, x+w, y+h)
+}
+
+func TestRecordWriterCSV(t *testing.T) {
+	var buf bytes.Buffer
+	rw := newRecordWriter(&buf, "csv", false)
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := rw.write(testRecords(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"image", "subimage", "rank", "match", "x", "y", "w", "h", "scale", "angle", "flip", "frame", "swapped", "elapsed"},
+		{"a.png", "needle.png", "1", "0.900000", "10", "20", "30", "40", "1", "0", "none", "0", "false", "1.500"},
+		{"a.png", "needle.png", "2", "0.800000", "50", "60", "30", "40", "1", "0", "h", "0", "false", "1.500"},
+		{"b.png", "needle.png", "1", "0.900000", "10", "20", "30", "40", "1", "0", "none", "0", "false", "1.500"},
+		{"b.png", "needle.png", "2", "0.800000", "50", "60", "30", "40", "1", "0", "h", "0", "false", "1.500"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %d:\n%s", len(want), len(rows), buf.String())
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d: expected %v, got %v", i, want[i], rows[i])
+		}
+	}
+}
+
+func TestRecordWriterCSVRaw(t *testing.T) {
+	var buf bytes.Buffer
+	records := testRecords("a.png")
+	records[0].Raw = &rawBounds{X: 1, Y: 2, W: 3, H: 4}
+	if err := newRecordWriter(&buf, "csv", true).write(records); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if got := strings.Join(rows[0][8:12], ","); got != "raw_x,raw_y,raw_w,raw_h" {
+		t.Errorf("expected raw columns in header, got %s", got)
+	}
+	if got := strings.Join(rows[1][8:12], ","); got != "1,2,3,4" {
+		t.Errorf("expected raw bounds 1,2,3,4, got %s", got)
+	}
+	if got := strings.Join(rows[2][8:12], ","); got != "0,0,0,0" {
+		t.Errorf("expected empty raw bounds, got %s", got)
+	}
+}
+
+func TestRecordWriterNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	rw := newRecordWriter(&buf, "ndjson", false)
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := rw.write(testRecords(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := append(testRecords("a.png"), testRecords("b.png")...)
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(want), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if r != want[i] {
+			t.Errorf("line %d: expected %+v, got %+v", i, want[i], r)
+		}
+	}
+}